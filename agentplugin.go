@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// agentStateMachines are the state machines the virtual agent plugin implements
+var agentStateMachines = map[string]bool{
+	"identity-v1":  true,
+	"recipient-v1": true,
+}
+
+// serveAgentPlugin runs a session of the virtual agent plugin
+func (s *Server) serveAgentPlugin(conn net.Conn, req *handshakeRequest, sess *session) error {
+	// Cancelling the session closes the connection, ending the exchange
+	sess.setUpstream(conn)
+
+	t := &protocolTap{
+		ageR: bufio.NewReader(&countingReader{r: conn, count: &sess.bytesIn}),
+		ageW: &countingWriter{w: conn, count: &sess.bytesOut},
+	}
+
+	if req.Options.StateMachine == "recipient-v1" {
+		return s.serveAgentRecipients(t, sess)
+	}
+	return s.serveAgentIdentities(t, req, sess)
+}
+
+// serveAgentIdentities runs the identity-v1 state machine. Plain agent
+// identities are served from the identities held in memory, identity stubs
+// by running the plugin they stand for.
+func (s *Server) serveAgentIdentities(t *protocolTap, req *handshakeRequest, sess *session) error {
+	// Phase 1: age sends the identities and the recipient stanzas of each
+	// file. age only listens once it is done, so an invalid identity is
+	// reported then.
+	useMemory := false
+	var targets []string
+	stubIdentities := make(map[string][]string)
+	files := make(map[int][]*Stanza)
+	identityIndex := 0
+	var invalid *Stanza
+	for done := false; !done; {
+		stanza, err := t.fromAge()
+		if err != nil {
+			return err
+		}
+
+		switch stanza.Type {
+		case "add-identity":
+			if len(stanza.Args) != 1 {
+				return fmt.Errorf("malformed add-identity command")
+			}
+			if invalid != nil {
+				continue
+			}
+			target, identity, err := s.resolveAgentIdentity(stanza.Args[0])
+			if err != nil {
+				sess.log.Warn("invalid agent identity", "err", err)
+				invalid = &Stanza{Type: "error", Args: []string{"identity", strconv.Itoa(identityIndex)}, Body: []byte(err.Error())}
+				continue
+			}
+			identityIndex++
+
+			if target == "" {
+				useMemory = true
+				continue
+			}
+			if _, ok := stubIdentities[target]; !ok {
+				targets = append(targets, target)
+			}
+			stubIdentities[target] = append(stubIdentities[target], identity)
+		case "recipient-stanza":
+			if len(stanza.Args) < 2 {
+				return fmt.Errorf("malformed recipient-stanza command")
+			}
+			fileIndex, err := strconv.Atoi(stanza.Args[0])
+			if err != nil || fileIndex < 0 {
+				return fmt.Errorf("malformed file index: %q", stanza.Args[0])
+			}
+			files[fileIndex] = append(files[fileIndex], stanza)
+		case "done":
+			done = true
+		default:
+			// Unknown commands, including grease, are ignored
+		}
+	}
+	if invalid != nil {
+		t.sendError(invalid)
+		return nil
+	}
+
+	fileIndexes := make([]int, 0, len(files))
+	for fileIndex := range files {
+		fileIndexes = append(fileIndexes, fileIndex)
+	}
+	sort.Ints(fileIndexes)
+	resolved := make(map[int]bool)
+
+	// Phase 2: report a file key for every file one of our identities can
+	// decrypt, waiting for age to acknowledge each command
+	for _, fileIndex := range fileIndexes {
+		if !useMemory {
+			break
+		}
+
+		stanzas := make([]*age.Stanza, 0, len(files[fileIndex]))
+		for _, stanza := range files[fileIndex] {
+			stanzas = append(stanzas, &age.Stanza{Type: stanza.Args[1], Args: stanza.Args[2:], Body: stanza.Body})
+		}
+
+		fileKey, recipient, err := s.unwrapFileKey(stanzas, req, sess)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			sess.log.Info("no identity matches file", "file", fileIndex)
+			continue
+		}
+
+		if err != nil {
+			sess.log.Warn("failed to unwrap file key", "file", fileIndex, "err", err)
+			t.deny(err)
+			return nil
+		}
+		sess.log.Info("file key unwrapped", "file", fileIndex, "recipient", recipient)
+		resolved[fileIndex] = true
+
+		_, err = t.ask(&Stanza{Type: "file-key", Args: []string{strconv.Itoa(fileIndex)}, Body: fileKey})
+		wipe(fileKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Then let the plugins behind identity stubs try the remaining files
+	for _, target := range targets {
+		if len(resolved) == len(files) {
+			break
+		}
+
+		gaveUp, err := s.relayStubPlugin(t, target, stubIdentities[target], files, fileIndexes, resolved, req, sess)
+		if err != nil || gaveUp {
+			return err
+		}
+	}
+
+	return t.toAge(&Stanza{Type: "done"})
+}
+
+// unwrapFileKey finds the identity for the stanzas of one file and returns
+// the file key once the identity's constraints allow this use
+func (s *Server) unwrapFileKey(stanzas []*age.Stanza, req *handshakeRequest, sess *session) ([]byte, string, error) {
+	fileKey, recipient, err := s.identities.unwrap(stanzas)
+	if err != nil {
+		return nil, "", err
+	}
+
+	confirm, err := s.identities.reserveUse(recipient)
+	if err != nil {
+		wipe(fileKey)
+		return nil, "", err
+	}
+
+	if confirm {
+		via := "this host"
+		if len(req.Options.Via) > 0 {
+			via = strings.Join(req.Options.Via, " -> ")
+		}
+		question := fmt.Sprintf("Allow %s via %s to decrypt with identity %s?", sess.peer, via, recipient)
+
+		confirmed, err := s.askConfirmation(question)
+		if err != nil || !confirmed {
+			s.identities.releaseUse(recipient)
+			wipe(fileKey)
+			if err != nil {
+				return nil, "", err
+			}
+			return nil, "", fmt.Errorf("use of identity %s was refused on the agent", recipient)
+		}
+	}
+
+	s.identities.finishUse(recipient)
+	return fileKey, recipient, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+// runAgentPlugin plays age's side of an identity-v1 session against the
+// virtual agent plugin and returns the commands the plugin sent
+func runAgentPlugin(t *testing.T, server *Server, identity string, files [][]*age.Stanza) []*Stanza {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	req := &handshakeRequest{PluginName: AgentPluginName, Options: handshakeOptions{StateMachine: "identity-v1"}}
+	sess := server.sessions.add(AgentPluginName, "test")
+	sess.policy = newPolicySession(serverConn, req)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.serveAgentPlugin(serverConn, req, sess)
+		serverConn.Close()
+	}()
+
+	// Like age, only start listening once phase 1 is sent
+	phase1 := []*Stanza{{Type: "add-identity", Args: []string{identity}}, {Type: "grease-x"}}
+	for i, stanzas := range files {
+		for _, s := range stanzas {
+			args := append([]string{strconv.Itoa(i), s.Type}, s.Args...)
+			phase1 = append(phase1, &Stanza{Type: "recipient-stanza", Args: args, Body: s.Body})
+		}
+	}
+	clientConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	for _, stanza := range append(phase1, &Stanza{Type: "done"}) {
+		if err := writeStanza(clientConn, stanza); err != nil {
+			t.Fatalf("failed to send phase 1: %v", err)
+		}
+	}
+	clientConn.SetWriteDeadline(time.Time{})
+
+	var commands []*Stanza
+	reader := bufio.NewReader(clientConn)
+	for {
+		command, err := readStanza(reader)
+		if err != nil {
+			t.Fatalf("failed to read plugin command: %v", err)
+		}
+		commands = append(commands, command)
+		if command.Type == "done" {
+			break
+		}
+		writeStanza(clientConn, &Stanza{Type: "ok"})
+		if command.Type == "error" {
+			break
+		}
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("serveAgentPlugin() error = %v", err)
+	}
+	return commands
+}
+
+func TestServeAgentPlugin(t *testing.T) {
+	held, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(&Config{})
+	server.identities.add(held, addOptions{})
+
+	fileKey := bytes.Repeat([]byte{7}, 16)
+	heldStanzas, err := held.Recipient().Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherStanzas, err := other.Recipient().Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// File 0 is encrypted to another key only, file 1 to the held key too
+	commands := runAgentPlugin(t, server, plugin.EncodeIdentity(AgentPluginName, nil), [][]*age.Stanza{
+		otherStanzas,
+		append(otherStanzas, heldStanzas...),
+	})
+
+	if len(commands) != 2 {
+		t.Fatalf("expected a file key and done, got %d commands", len(commands))
+	}
+	if commands[0].Type != "file-key" || len(commands[0].Args) != 1 || commands[0].Args[0] != "1" {
+		t.Errorf("unexpected command: -> %s %v", commands[0].Type, commands[0].Args)
+	}
+	if !bytes.Equal(commands[0].Body, fileKey) {
+		t.Errorf("file key = %x, want %x", commands[0].Body, fileKey)
+	}
+	if commands[1].Type != "done" {
+		t.Errorf("expected done, got %s", commands[1].Type)
+	}
+}
+
+func TestServeAgentPluginConstraints(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      addOptions
+		confirm   bool
+		wantTypes [][]string
+	}{
+		{
+			name:      "used up after one file key",
+			opts:      addOptions{MaxUses: 1},
+			wantTypes: [][]string{{"file-key", "done"}, {"done"}},
+		},
+		{
+			name:      "confirmed on the agent",
+			opts:      addOptions{Confirm: true},
+			confirm:   true,
+			wantTypes: [][]string{{"file-key", "done"}, {"file-key", "done"}},
+		},
+		{
+			name:      "refused on the agent",
+			opts:      addOptions{Confirm: true, MaxUses: 1},
+			confirm:   false,
+			wantTypes: [][]string{{"error"}, {"error"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := age.GenerateX25519Identity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stanzas, err := identity.Recipient().Wrap(bytes.Repeat([]byte{7}, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := newServer(&Config{Pinentry: fakePinentry(t, "", tt.confirm)})
+			if _, _, err := server.identities.add(identity, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.wantTypes {
+				commands := runAgentPlugin(t, server, plugin.EncodeIdentity(AgentPluginName, nil), [][]*age.Stanza{stanzas})
+				var got []string
+				for _, command := range commands {
+					got = append(got, command.Type)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("session %d: commands = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
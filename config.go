@@ -1,6 +1,125 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
 // Config stores runtime configuration
 type Config struct {
-	SocketPath string
+	SocketPath string `json:"-"`
+	// LockIdle locks the agent after this long without sessions (0 disables)
+	LockIdle time.Duration `json:"-"`
+	// LockCommand is a hook command whose output lines lock the agent
+	LockCommand string `json:"-"`
+	// Replace asks an agent already listening on SocketPath to shut down
+	Replace bool `json:"-"`
+	// Pinentry is the program asking for identity file passphrases when
+	// the agent has no terminal, or should not use it
+	Pinentry string `json:"-"`
+	// LogLevel, LogFormat and LogFile configure the server's logger
+	LogLevel  string `json:"-"`
+	LogFormat string `json:"-"`
+	LogFile   string `json:"-"`
+
+	// Upstreams maps plugin names to the sockets of upstream agents that
+	// serve them, instead of running a local plugin binary
+	Upstreams map[string]string `json:"upstreams"`
+
+	// RecipientGroups maps group names to the X25519 recipients that the
+	// agent plugin encrypts to for the group's age1agent1... recipient
+	RecipientGroups map[string][]string `json:"recipient_groups"`
+
+	// ClientPrompts maps plugin names to "msg" or "confirm". Before such a
+	// plugin acts, the agent tells the user at the client, or asks them
+	ClientPrompts map[string]string `json:"client_prompts"`
+
+	// SecretPrompts maps plugin names to a regular expression. The agent
+	// answers the plugin's request-secret prompts that match it with the
+	// PIN set by the pin command, instead of passing them to the client.
+	SecretPrompts map[string]string `json:"secret_prompts"`
+
+	// Policy is the list of rules deciding whether to allow, deny or confirm
+	// each message of plugin sessions; messages no rule matches are allowed
+	Policy []PolicyRule `json:"policy"`
+}
+
+// defaultConfigPath returns the path of the server configuration file
+func defaultConfigPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(homeDir, ".config")
+	}
+	return filepath.Join(configHome, "age-plugin-agent", "config.json")
+}
+
+// loadConfigFile reads the JSON configuration file into config. A missing
+// file is only an error if required is set.
+func loadConfigFile(config *Config, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return config.validate()
+}
+
+// validate checks the configuration for values the server can't use
+func (c *Config) validate() error {
+	for pluginName, socketPath := range c.Upstreams {
+		if err := validatePluginName(pluginName); err != nil {
+			return fmt.Errorf("invalid upstream plugin name %q: %w", pluginName, err)
+		}
+		if socketPath == "" {
+			return fmt.Errorf("upstream for plugin %q has no socket path", pluginName)
+		}
+	}
+	for group, members := range c.RecipientGroups {
+		if !groupNameRegex.MatchString(group) {
+			return fmt.Errorf("invalid recipient group name %q", group)
+		}
+		if len(members) == 0 {
+			return fmt.Errorf("recipient group %q has no members", group)
+		}
+		if _, err := parseRecipientGroup(members); err != nil {
+			return fmt.Errorf("recipient group %q: %w", group, err)
+		}
+	}
+	for pluginName, prompt := range c.ClientPrompts {
+		if err := validatePluginName(pluginName); err != nil {
+			return fmt.Errorf("invalid client prompt plugin name %q: %w", pluginName, err)
+		}
+		if prompt != clientPromptMsg && prompt != clientPromptConfirm {
+			return fmt.Errorf("client prompt for plugin %q must be %q or %q", pluginName, clientPromptMsg, clientPromptConfirm)
+		}
+	}
+	for pluginName, pattern := range c.SecretPrompts {
+		if err := validatePluginName(pluginName); err != nil {
+			return fmt.Errorf("invalid secret prompt plugin name %q: %w", pluginName, err)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("secret prompt for plugin %q: %w", pluginName, err)
+		}
+	}
+	for i := range c.Policy {
+		if err := c.Policy[i].validate(); err != nil {
+			return fmt.Errorf("policy rule %d: %w", i+1, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{
+			name:     "upstreams",
+			contents: `{"upstreams": {"yubikey": "/run/upstream.sock"}}`,
+			wantErr:  false,
+		},
+		{
+			name:     "invalid upstream plugin name",
+			contents: `{"upstreams": {"../yubikey": "/run/upstream.sock"}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "empty upstream socket",
+			contents: `{"upstreams": {"yubikey": ""}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "malformed JSON",
+			contents: `{"upstreams": `,
+			wantErr:  true,
+		},
+		{
+			name:     "recipient group",
+			contents: `{"recipient_groups": {"team-prod": ["age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"]}}`,
+			wantErr:  false,
+		},
+		{
+			name:     "invalid recipient in group",
+			contents: `{"recipient_groups": {"team-prod": ["age1nope"]}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "empty recipient group",
+			contents: `{"recipient_groups": {"team-prod": []}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid recipient group name",
+			contents: `{"recipient_groups": {"Team Prod": ["age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"]}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "client prompts",
+			contents: `{"client_prompts": {"yubikey": "confirm", "tpm": "msg"}}`,
+			wantErr:  false,
+		},
+		{
+			name:     "unknown client prompt",
+			contents: `{"client_prompts": {"yubikey": "ask"}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "secret prompts",
+			contents: `{"secret_prompts": {"yubikey": "PIN", "tpm": ""}}`,
+			wantErr:  false,
+		},
+		{
+			name:     "invalid secret prompt pattern",
+			contents: `{"secret_prompts": {"yubikey": "PIN("}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "policy",
+			contents: `{"policy": [{"plugin": "yubikey", "state_machine": "recipient-v1", "action": "allow"}, {"plugin": "yubikey", "action": "confirm"}]}`,
+			wantErr:  false,
+		},
+		{
+			name:     "invalid policy rule",
+			contents: `{"policy": [{"plugin": "yubikey", "action": "maybe"}]}`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid client prompt plugin name",
+			contents: `{"client_prompts": {"../yubikey": "msg"}}`,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.contents), 0600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			config := &Config{SocketPath: "/run/agent.sock"}
+			err := loadConfigFile(config, path, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if config.SocketPath != "/run/agent.sock" {
+				t.Errorf("loadConfigFile() changed SocketPath to %q", config.SocketPath)
+			}
+		})
+	}
+
+	t.Run("missing optional file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "missing.json")
+		if err := loadConfigFile(&Config{}, path, false); err != nil {
+			t.Errorf("loadConfigFile() error = %v, want nil", err)
+		}
+		if err := loadConfigFile(&Config{}, path, true); err == nil {
+			t.Errorf("loadConfigFile() of missing required file should fail")
+		}
+	})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// handleControl answers a control command sent in place of a plugin name
+func (s *Server) handleControl(conn net.Conn, req *handshakeRequest) error {
+	switch req.Command {
+	case "status":
+		return writeControlResponse(conn, s.status())
+	case "list":
+		plugins := findAvailablePlugins(false)
+		for i := range plugins {
+			plugins[i].Version = pluginVersion(plugins[i].Path)
+		}
+		plugins = append([]PluginInfo{{Name: AgentPluginName, Path: "(built-in)", Version: Version}}, plugins...)
+		return writeControlResponse(conn, plugins)
+	case "sessions":
+		return writeControlResponse(conn, s.sessions.list())
+	case "add":
+		return s.handleAddIdentities(conn, req.Args)
+	case "identities":
+		return writeControlResponse(conn, s.identities.list())
+	case "groups":
+		return writeControlResponse(conn, s.recipientGroups())
+	case "stub":
+		return s.handleStub(conn, req.Args)
+	case "pin":
+		return s.handlePIN(conn, req.Args)
+	case "forget-pin":
+		if len(req.Args) != 1 {
+			conn.Write([]byte("ERROR forget-pin requires a plugin name\n"))
+			return fmt.Errorf("forget-pin requires a plugin name")
+		}
+		forgotten := s.pins.forget(req.Args[0])
+		if forgotten {
+			logger.Info("PIN forgotten by control command", "plugin", req.Args[0])
+		}
+		return writeControlResponse(conn, forgotten)
+	case "remove":
+		if len(req.Args) != 1 {
+			conn.Write([]byte("ERROR remove requires a recipient\n"))
+			return fmt.Errorf("remove requires a recipient")
+		}
+		if err := s.identities.remove(req.Args[0]); err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+			return err
+		}
+		logger.Info("identity removed by control command", "recipient", req.Args[0])
+		return writeControlResponse(conn, nil)
+	case "remove-all":
+		removed := s.identities.removeAll() + s.stubs.removeAll()
+		logger.Info("all identities removed by control command", "count", removed)
+		return writeControlResponse(conn, removed)
+	case "cancel":
+		if len(req.Args) != 1 {
+			conn.Write([]byte("ERROR cancel requires a session ID\n"))
+			return fmt.Errorf("cancel requires a session ID")
+		}
+		id, err := strconv.ParseUint(req.Args[0], 10, 64)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR invalid session ID: %s\n", req.Args[0])))
+			return fmt.Errorf("invalid session ID: %s", req.Args[0])
+		}
+		if err := s.sessions.cancel(id); err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+			return err
+		}
+		logger.Info("session cancelled by control command", "session", id)
+		return writeControlResponse(conn, nil)
+	case "shutdown":
+		logger.Info("shutdown requested by control command")
+		if err := writeControlResponse(conn, nil); err != nil {
+			return err
+		}
+		s.requestShutdown()
+		return nil
+	case "lock", "unlock":
+		if len(req.Args) != 1 {
+			conn.Write([]byte(fmt.Sprintf("ERROR %s requires a passphrase\n", req.Command)))
+			return fmt.Errorf("%s requires a passphrase", req.Command)
+		}
+		passphrase, err := base64.StdEncoding.DecodeString(req.Args[0])
+		if err != nil {
+			conn.Write([]byte("ERROR malformed passphrase\n"))
+			return fmt.Errorf("malformed passphrase: %w", err)
+		}
+		if req.Command == "lock" {
+			err = s.lock.lock(passphrase)
+		} else {
+			err = s.lock.unlock(passphrase)
+		}
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+			return err
+		}
+		logger.Info("agent lock state changed by control command", "command", req.Command)
+		return writeControlResponse(conn, nil)
+	default:
+		conn.Write([]byte(fmt.Sprintf("ERROR unknown control command: %s\n", req.Command)))
+		return fmt.Errorf("unknown control command: %s", req.Command)
+	}
+}
+
+// status builds the reply to the status control command
+func (s *Server) status() *StatusResponse {
+	return &StatusResponse{
+		Version:         Version,
+		ProtocolVersion: ProtocolVersion,
+		Started:         s.started,
+		Listeners:       []string{s.config.SocketPath},
+		Locked:          s.lock.isLocked(),
+		Upstreams:       s.config.Upstreams,
+		Identities:      len(s.identities.list()),
+		Sessions:        s.sessions.list(),
+	}
+}
+
+// writeControlResponse sends OK followed by the JSON encoded reply
+func writeControlResponse(conn net.Conn, reply any) error {
+	if _, err := conn.Write([]byte("OK\n")); err != nil {
+		return fmt.Errorf("failed to send OK response: %w", err)
+	}
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return nil
+}
+
+// controlTimeouts extends the deadline of control commands that may wait
+// for a human at the agent
+var controlTimeouts = map[string]time.Duration{
+	"add": 2 * time.Minute,
+	"pin": 2 * time.Minute,
+}
+
+// performControl sends a control command to the server and decodes its JSON reply
+func performControl(conn net.Conn, command string, args []string, reply any) error {
+	timeout, ok := controlTimeouts[command]
+	if !ok {
+		timeout = 10 * time.Second
+	}
+
+	// Set deadline for the whole exchange
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+
+	line := ControlPrefix + strings.Join(append([]string{command}, args...), " ")
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		return fmt.Errorf("failed to send control command: %w", err)
+	}
+
+	// Read response
+	reader := bufio.NewReader(conn)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read control response: %w", err)
+	}
+
+	response = strings.TrimSpace(response)
+
+	if strings.HasPrefix(response, "ERROR ") {
+		errorMsg := strings.TrimPrefix(response, "ERROR ")
+		return fmt.Errorf("server error: %s", errorMsg)
+	}
+	if response != "OK" {
+		return fmt.Errorf("unexpected control response: %s", response)
+	}
+
+	// Read the reply even when the caller has no use for it, so that the
+	// server doesn't write to a closed connection
+	if reply == nil {
+		var ignored any
+		reply = &ignored
+	}
+	if err := json.NewDecoder(reader).Decode(reply); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode control reply: %w", err)
+	}
+	return nil
+}
+
+// dialAgent connects to the first candidate socket with a listening agent
+func dialAgent() (net.Conn, string, error) {
+	candidates := getSocketCandidates()
+	var reasons []string
+
+	for _, socketPath := range candidates {
+		if err := checkSocketPath(socketPath); err != nil {
+			reasons = append(reasons, fmt.Sprintf("skipping %s: %v", socketPath, err))
+			continue
+		}
+
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			return conn, socketPath, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", socketPath, err))
+	}
+
+	return nil, "", fmt.Errorf("failed to connect to server: %s", strings.Join(reasons, "; "))
+}
+
+// dialControl connects to the server and runs a single control command
+func dialControl(command string, args []string, reply any) error {
+	conn, _, err := dialAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return performControl(conn, command, args, reply)
+}
+
+// runStatus implements the status subcommand
+func runStatus() error {
+	var status StatusResponse
+	if err := dialControl("status", nil, &status); err != nil {
+		return err
+	}
+
+	fmt.Printf("Server version:  %s (protocol %d)\n", status.Version, status.ProtocolVersion)
+	fmt.Printf("Uptime:          %s\n", time.Since(status.Started).Round(time.Second))
+	fmt.Printf("Listeners:       %s\n", strings.Join(status.Listeners, ", "))
+	fmt.Printf("Locked:          %t\n", status.Locked)
+	for _, pluginName := range sortedKeys(status.Upstreams) {
+		fmt.Printf("Upstream:        %s -> %s\n", pluginName, status.Upstreams[pluginName])
+	}
+	fmt.Printf("Identities:      %d\n", status.Identities)
+	fmt.Printf("Active sessions: %d\n", len(status.Sessions))
+
+	if len(status.Sessions) > 0 {
+		fmt.Println()
+		printSessions(os.Stdout, status.Sessions)
+	}
+
+	return nil
+}
+
+// printSessions writes a table of sessions to w
+func printSessions(w io.Writer, sessions []SessionInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPLUGIN\tPEER\tDURATION\tBYTES IN\tBYTES OUT")
+	for _, sess := range sessions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\n",
+			sess.ID, sess.Plugin, sess.Peer,
+			time.Since(sess.Started).Round(time.Second),
+			sess.BytesIn, sess.BytesOut)
+	}
+	tw.Flush()
+}
+
+// runList implements the list subcommand
+func runList() error {
+	var plugins []PluginInfo
+	if err := dialControl("list", nil, &plugins); err != nil {
+		return err
+	}
+
+	if len(plugins) == 0 {
+		fmt.Println("No plugins found on the server's PATH")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tPATH")
+	for _, plugin := range plugins {
+		version := plugin.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", plugin.Name, version, plugin.Path)
+	}
+	return tw.Flush()
+}
+
+// runSessions implements the sessions subcommand
+func runSessions() error {
+	var sessions []SessionInfo
+	if err := dialControl("sessions", nil, &sessions); err != nil {
+		return err
+	}
+
+	if len(sessions) == 0 {
+		fmt.Println("No active sessions")
+		return nil
+	}
+
+	printSessions(os.Stdout, sessions)
+	return nil
+}
+
+// runCancel implements the cancel subcommand
+func runCancel(sessionID string) error {
+	if err := dialControl("cancel", []string{sessionID}, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Session %s cancelled\n", sessionID)
+	return nil
+}
+
+// runLock implements the lock subcommand
+func runLock() error {
+	passphrase, err := readPassphrase("Enter lock passphrase: ")
+	if err != nil {
+		return err
+	}
+	confirmation, err := readPassphrase("Confirm lock passphrase: ")
+	if err != nil {
+		return err
+	}
+	if string(passphrase) != string(confirmation) {
+		return fmt.Errorf("passphrases do not match")
+	}
+
+	if err := dialControl("lock", []string{base64.StdEncoding.EncodeToString(passphrase)}, nil); err != nil {
+		return err
+	}
+
+	fmt.Println("Agent locked")
+	return nil
+}
+
+// runUnlock implements the unlock subcommand
+func runUnlock() error {
+	passphrase, err := readPassphrase("Enter lock passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	if err := dialControl("unlock", []string{base64.StdEncoding.EncodeToString(passphrase)}, nil); err != nil {
+		return err
+	}
+
+	fmt.Println("Agent unlocked")
+	return nil
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPerformControl(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		wantErr     bool
+		errContains string
+	}{
+		{
+			name:    "status",
+			command: "status",
+			wantErr: false,
+		},
+		{
+			name:        "unknown command",
+			command:     "frobnicate",
+			wantErr:     true,
+			errContains: "unknown control command",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(&Config{SocketPath: "/test/agent.sock"})
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+
+			go server.handleConnection(serverConn)
+
+			var status StatusResponse
+			err := performControl(clientConn, tt.command, nil, &status)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("performControl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.errContains) {
+					t.Errorf("error should contain %q, got %q", tt.errContains, err.Error())
+				}
+				return
+			}
+
+			if status.Version != Version {
+				t.Errorf("status version = %q, want %q", status.Version, Version)
+			}
+			if status.ProtocolVersion != ProtocolVersion {
+				t.Errorf("status protocol version = %d, want %d", status.ProtocolVersion, ProtocolVersion)
+			}
+			if len(status.Listeners) != 1 || status.Listeners[0] != "/test/agent.sock" {
+				t.Errorf("status listeners = %v, want [/test/agent.sock]", status.Listeners)
+			}
+		})
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	registry := newSessionRegistry()
+
+	first := registry.add("yubikey", "uid=1000 pid=1")
+	second := registry.add("tpm", "uid=1000 pid=2")
+
+	sessions := registry.list()
+	if len(sessions) != 2 {
+		t.Fatalf("list() returned %d sessions, want 2", len(sessions))
+	}
+	if sessions[0].ID != first.id || sessions[1].ID != second.id {
+		t.Errorf("list() not ordered by ID: %v", sessions)
+	}
+
+	if err := registry.cancel(first.id); err != nil {
+		t.Errorf("cancel(%d) error = %v", first.id, err)
+	}
+	if !first.isCancelled() {
+		t.Errorf("session %d not marked cancelled", first.id)
+	}
+	if err := registry.cancel(42); err == nil {
+		t.Errorf("cancel(42) of unknown session should fail")
+	}
+
+	registry.remove(first.id)
+	sessions = registry.list()
+	if len(sessions) != 1 || sessions[0].Plugin != "tpm" {
+		t.Errorf("after remove, list() = %v, want only tpm session", sessions)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// doctorReport collects the results of the doctor checks
+type doctorReport struct {
+	failures int
+}
+
+func (r *doctorReport) pass(format string, args ...any) {
+	fmt.Printf("[PASS] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) warn(format string, args ...any) {
+	fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) fail(format string, args ...any) {
+	r.failures++
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, args...))
+}
+
+// runDoctor implements the doctor subcommand
+func runDoctor(pluginName string) error {
+	report := &doctorReport{}
+
+	if pluginName != "" {
+		if err := validatePluginName(pluginName); err != nil {
+			return fmt.Errorf("invalid plugin name %q: %w", pluginName, err)
+		}
+	}
+
+	// Socket path resolution
+	candidates := getSocketCandidates()
+	if os.Getenv("AGE_PLUGIN_AGENT_SOCKET") != "" {
+		report.pass("Socket candidates %s (AGE_PLUGIN_AGENT_SOCKET first)", strings.Join(candidates, ", "))
+	} else {
+		report.pass("Socket candidates %s (AGE_PLUGIN_AGENT_SOCKET is not set)", strings.Join(candidates, ", "))
+	}
+
+	// Check the first socket with a listening agent, as clients would use it
+	socketPath := candidates[0]
+	if conn, path, err := dialAgent(); err == nil {
+		conn.Close()
+		socketPath = path
+	}
+	report.pass("Checking socket %s", socketPath)
+
+	if legacyPath := legacySocketPath(); legacyPath != "" && legacyPath != socketPath {
+		if _, err := os.Lstat(legacyPath); err == nil {
+			report.warn("A socket exists at the old default path %s, the default is now %s", legacyPath, getSocketPath())
+		}
+	}
+
+	socketOK := checkSocketFile(report, socketPath)
+	serverOK := socketOK && checkServer(report, socketPath)
+	checkShims(report, pluginName)
+
+	if pluginName != "" && serverOK {
+		checkSession(report, socketPath, pluginName)
+	}
+
+	fmt.Println()
+	if report.failures > 0 {
+		return fmt.Errorf("%d check(s) failed", report.failures)
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
+
+// checkSocketFile verifies the socket exists with safe ownership and permissions
+func checkSocketFile(report *doctorReport, socketPath string) bool {
+	if err := checkSocketPath(socketPath); err != nil {
+		report.fail("Unsafe or missing socket directory, clients will not connect: %v", err)
+		return false
+	}
+	report.pass("Socket directory %s is safe to use", filepath.Dir(socketPath))
+
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		report.fail("Socket %s does not exist: is the server running, and is the socket forwarded over SSH?", socketPath)
+		return false
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		report.fail("%s is not a socket (mode %s)", socketPath, info.Mode())
+		return false
+	}
+	report.pass("Socket exists")
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if int(stat.Uid) == os.Getuid() {
+			report.pass("Socket is owned by the current user (uid %d)", stat.Uid)
+		} else {
+			report.fail("Socket is owned by uid %d, not the current user (uid %d)", stat.Uid, os.Getuid())
+		}
+	}
+
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		report.warn("Socket permissions %04o allow access by other users", perm)
+	} else {
+		report.pass("Socket permissions %04o", perm)
+	}
+
+	return true
+}
+
+// checkServer verifies a server answers on the socket and speaks our protocol
+func checkServer(report *doctorReport, socketPath string) bool {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		report.fail("Server is not reachable: %v (a stale socket is left behind if the server or SSH forward died)", err)
+		return false
+	}
+	defer conn.Close()
+
+	var status StatusResponse
+	if err := performControl(conn, "status", nil, &status); err != nil {
+		report.fail("Server did not answer the status command: %v (is it an older age-plugin-agent?)", err)
+		return false
+	}
+	report.pass("Server reachable, version %s, up %s", status.Version, time.Since(status.Started).Round(time.Second))
+
+	if status.ProtocolVersion != ProtocolVersion {
+		report.fail("Server speaks protocol %d, this client speaks protocol %d", status.ProtocolVersion, ProtocolVersion)
+		return false
+	}
+	report.pass("Protocol version %d matches", status.ProtocolVersion)
+
+	if status.Locked {
+		report.fail("Agent is locked: run 'age-plugin-agent unlock'")
+		return false
+	}
+
+	return true
+}
+
+// checkShims verifies that age-plugin-* names on $PATH resolve to this binary
+// where interception is expected
+func checkShims(report *doctorReport, pluginName string) {
+	if pluginName == "" {
+		var shims []string
+		for _, plugin := range findAvailablePlugins(true) {
+			if info, err := os.Stat(plugin.Path); err == nil && isOwnExecutable(info) {
+				shims = append(shims, plugin.Name)
+			}
+		}
+		if len(shims) == 0 {
+			report.warn("No plugins are intercepted on this PATH: run 'age-plugin-agent intercept <plugin>'")
+		} else {
+			report.pass("Intercepted plugins on PATH: %v", shims)
+		}
+		return
+	}
+
+	binaryName := "age-plugin-" + pluginName
+	path, err := exec.LookPath(binaryName)
+	if err != nil {
+		report.fail("%s is not on PATH, so age cannot find it: run 'age-plugin-agent intercept %s'", binaryName, pluginName)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !isOwnExecutable(info) {
+		target, _ := filepath.EvalSymlinks(path)
+		report.fail("%s resolves to %s, not age-plugin-agent: an earlier PATH entry shadows the intercept shim", binaryName, target)
+		return
+	}
+	report.pass("%s on PATH is an intercept shim (%s)", binaryName, path)
+}
+
+// checkSession runs a no-op plugin session: handshake, then close the input
+// and wait for the server to close the connection when the plugin exits
+func checkSession(report *doctorReport, socketPath string, pluginName string) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		report.fail("Failed to connect for a test session: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := performClientHandshake(conn, pluginName, handshakeOptions{}); err != nil {
+		report.fail("Plugin %s is not available on the server: %v (see 'age-plugin-agent list')", pluginName, err)
+		return
+	}
+	report.pass("Plugin %s is available on the server", pluginName)
+
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		unixConn.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		report.fail("No-op session did not finish: %v", err)
+		return
+	}
+	report.pass("No-op session round trip completed")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSocketFile(t *testing.T) {
+	dir := t.TempDir()
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to create test listener: %v", err)
+	}
+	defer listener.Close()
+	os.Chmod(socketPath, 0600)
+
+	regularPath := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regularPath, nil, 0600); err != nil {
+		t.Fatalf("Failed to create regular file: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		wantOK       bool
+		wantFailures int
+	}{
+		{"live socket", socketPath, true, 0},
+		{"missing socket", filepath.Join(dir, "missing.sock"), false, 1},
+		{"regular file", regularPath, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &doctorReport{}
+			if got := checkSocketFile(report, tt.path); got != tt.wantOK {
+				t.Errorf("checkSocketFile() = %v, want %v", got, tt.wantOK)
+			}
+			if report.failures != tt.wantFailures {
+				t.Errorf("checkSocketFile() failures = %d, want %d", report.failures, tt.wantFailures)
+			}
+		})
+	}
+}
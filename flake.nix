@@ -14,8 +14,8 @@
         pname = "age-plugin-agent";
         version = "0.1.0";
         src = self;
-        # No external Go module dependencies
-        vendorHash = null;
+        # Hash of the vendored Go module dependencies; update it with go.mod
+        vendorHash = "sha256-pGsnYWISZXsGwp0OmspyuH9y6e4gvXD1k3pI5o1rzV4=";
 
         meta = with pkgs.lib; {
           description = "Age plugin proxy agent that forwards encryption/decryption to a remote server";
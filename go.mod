@@ -1,3 +1,9 @@
 module age-plugin-agent
 
-go 1.18
+go 1.21
+
+require (
+	filippo.io/age v1.2.1
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0
+)
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// passphraseAttempts is how often the agent asks for the passphrase of an
+// encrypted identity file before giving up
+const passphraseAttempts = 3
+
+// storedIdentity is an identity held in the agent's memory. The secret key
+// lives in a locked buffer between uses. The age library only takes keys as
+// strings, so loading the key and every use of it leave copies on the Go
+// heap that can't be wiped.
+type storedIdentity struct {
+	secret    *lockedBuffer
+	recipient string
+	added     time.Time
+	expires   time.Time
+	timer     *time.Timer
+
+	// maxUses is how many file keys the identity may unwrap (0 for no limit)
+	maxUses int
+	uses    int
+	// confirm asks the human at the agent before every use
+	confirm bool
+}
+
+// identityStore holds the X25519 identities served by the virtual agent plugin
+type identityStore struct {
+	mu         sync.Mutex
+	identities []*storedIdentity
+}
+
+// newIdentityStore creates an empty identity store
+func newIdentityStore() *identityStore {
+	return &identityStore{}
+}
+
+// addOptions are the constraints given to the add control command
+type addOptions struct {
+	// Lifetime removes the identity after this long (0 keeps it until removed)
+	Lifetime time.Duration
+	// MaxUses removes the identity after unwrapping this many file keys
+	MaxUses int
+	// Confirm asks the human at the agent before every use of the identity
+	Confirm bool
+}
+
+// add stores an identity, reporting false if it was already held. Adding
+// an identity again replaces its constraints.
+func (s *identityStore) add(identity *age.X25519Identity, opts addOptions) (IdentityInfo, bool, error) {
+	encoded := []byte(identity.String())
+	secret, err := newLockedBuffer(encoded)
+	wipe(encoded)
+	if err != nil {
+		return IdentityInfo{}, false, err
+	}
+	stored := &storedIdentity{
+		secret:    secret,
+		recipient: identity.Recipient().String(),
+		added:     time.Now(),
+		maxUses:   opts.MaxUses,
+		confirm:   opts.Confirm,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	isNew := true
+	for i, existing := range s.identities {
+		if existing.recipient == stored.recipient {
+			existing.destroy()
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			isNew = false
+			break
+		}
+	}
+
+	if opts.Lifetime > 0 {
+		stored.expires = stored.added.Add(opts.Lifetime)
+		stored.timer = time.AfterFunc(opts.Lifetime, func() { s.expire(stored) })
+	}
+	s.identities = append(s.identities, stored)
+	return stored.info(), isNew, nil
+}
+
+// expire removes an identity whose lifetime ended, unless it was already
+// removed or replaced
+func (s *identityStore) expire(stored *storedIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.identities {
+		if existing == stored {
+			stored.destroy()
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			logger.Info("identity expired", "recipient", stored.recipient)
+			return
+		}
+	}
+}
+
+// remove drops the identity with the given recipient
+func (s *identityStore) remove(recipient string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.identities {
+		if stored.recipient == recipient {
+			stored.destroy()
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such identity: %s", recipient)
+}
+
+// removeAll drops every identity and returns how many there were
+func (s *identityStore) removeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.identities)
+	for _, stored := range s.identities {
+		stored.destroy()
+	}
+	s.identities = nil
+	return n
+}
+
+// list returns the public side of the stored identities in the order they were added
+func (s *identityStore) list() []IdentityInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]IdentityInfo, 0, len(s.identities))
+	for _, stored := range s.identities {
+		infos = append(infos, stored.info())
+	}
+	return infos
+}
+
+// unwrap tries every stored identity against the stanzas of one file and
+// returns the file key and the recipient of the identity that unwrapped it.
+// It returns age.ErrIncorrectIdentity if no identity matches.
+func (s *identityStore) unwrap(stanzas []*age.Stanza) ([]byte, string, error) {
+	// Parse the keys while holding the lock, since removing an identity
+	// releases its buffer
+	s.mu.Lock()
+	identities := make([]*age.X25519Identity, 0, len(s.identities))
+	recipients := make([]string, 0, len(s.identities))
+	for _, stored := range s.identities {
+		if stored.exhausted() {
+			continue
+		}
+		identity, err := age.ParseX25519Identity(string(stored.secret.data))
+		if err != nil {
+			s.mu.Unlock()
+			return nil, "", fmt.Errorf("corrupted identity %s: %w", stored.recipient, err)
+		}
+		identities = append(identities, identity)
+		recipients = append(recipients, stored.recipient)
+	}
+	s.mu.Unlock()
+
+	for i, identity := range identities {
+		fileKey, err := identity.Unwrap(stanzas)
+		if err == nil {
+			return fileKey, recipients[i], nil
+		}
+		if !errors.Is(err, age.ErrIncorrectIdentity) {
+			return nil, "", err
+		}
+	}
+	return nil, "", age.ErrIncorrectIdentity
+}
+
+// find returns the identity with the given recipient. The caller must hold s.mu.
+func (s *identityStore) find(recipient string) (int, *storedIdentity) {
+	for i, stored := range s.identities {
+		if stored.recipient == recipient {
+			return i, stored
+		}
+	}
+	return -1, nil
+}
+
+// reserveUse counts a use of an identity before its file key is handed out,
+// failing if the identity is gone or used up, and reports whether the use
+// needs to be confirmed
+func (s *identityStore) reserveUse(recipient string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, stored := s.find(recipient)
+	if stored == nil {
+		return false, fmt.Errorf("identity %s was removed", recipient)
+	}
+	if stored.exhausted() {
+		return false, fmt.Errorf("identity %s is used up", recipient)
+	}
+	stored.uses++
+	return stored.confirm, nil
+}
+
+// releaseUse gives back a reserved use that did not happen
+func (s *identityStore) releaseUse(recipient string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, stored := s.find(recipient); stored != nil && stored.uses > 0 {
+		stored.uses--
+	}
+}
+
+// finishUse removes an identity once its last use happened
+func (s *identityStore) finishUse(recipient string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, stored := s.find(recipient)
+	if stored == nil || !stored.exhausted() {
+		return
+	}
+	stored.destroy()
+	s.identities = append(s.identities[:i], s.identities[i+1:]...)
+	logger.Info("identity used up", "recipient", recipient, "uses", stored.uses)
+}
+
+// exhausted reports whether the identity reached its maximum number of uses
+func (s *storedIdentity) exhausted() bool {
+	return s.maxUses > 0 && s.uses >= s.maxUses
+}
+
+// info describes the stored identity without its secret key
+func (s *storedIdentity) info() IdentityInfo {
+	info := IdentityInfo{
+		Recipient: s.recipient,
+		Added:     s.added,
+		MaxUses:   s.maxUses,
+		Uses:      s.uses,
+		Confirm:   s.confirm,
+	}
+	if !s.expires.IsZero() {
+		expires := s.expires
+		info.Expires = &expires
+	}
+	return info
+}
+
+// destroy stops the expiry timer and wipes the secret key
+func (s *storedIdentity) destroy() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.secret.destroy()
+}
+
+// parseAddOptions splits the arguments of the add control command into
+// key=value constraints and base64 encoded identity files
+func parseAddOptions(args []string) (addOptions, []string, error) {
+	var opts addOptions
+	var files []string
+
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "lifetime":
+			lifetime, err := time.ParseDuration(value)
+			if err != nil || lifetime <= 0 {
+				return opts, nil, fmt.Errorf("invalid lifetime: %q", value)
+			}
+			opts.Lifetime = lifetime
+		case "uses":
+			maxUses, err := strconv.Atoi(value)
+			if err != nil || maxUses <= 0 {
+				return opts, nil, fmt.Errorf("invalid maximum number of uses: %q", value)
+			}
+			opts.MaxUses = maxUses
+		case "confirm":
+			opts.Confirm = true
+		default:
+			files = append(files, arg)
+		}
+	}
+	return opts, files, nil
+}
+
+// encode returns the key=value arguments for the constraints that are set
+func (o addOptions) encode() []string {
+	var args []string
+	if o.Lifetime > 0 {
+		args = append(args, "lifetime="+o.Lifetime.String())
+	}
+	if o.MaxUses > 0 {
+		args = append(args, "uses="+strconv.Itoa(o.MaxUses))
+	}
+	if o.Confirm {
+		args = append(args, "confirm")
+	}
+	return args
+}
+
+// isEncryptedIdentityFile reports whether data is an age encrypted file
+// rather than a plain identity file
+func isEncryptedIdentityFile(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return bytes.HasPrefix(trimmed, []byte("age-encryption.org/")) ||
+		bytes.HasPrefix(trimmed, []byte(armor.Header))
+}
+
+// parseIdentityFile parses the X25519 identities in the contents of an age
+// identity file
+func parseIdentityFile(data []byte) ([]*age.X25519Identity, error) {
+	parsed, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make([]*age.X25519Identity, 0, len(parsed))
+	for _, identity := range parsed {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			return nil, fmt.Errorf("only X25519 identities can be added to the agent")
+		}
+		identities = append(identities, x25519)
+	}
+	return identities, nil
+}
+
+// askPassphrase asks the human at the agent for a passphrase or PIN, named
+// by label, with the configured pinentry program or else on the server's
+// terminal. Prompts are serialized so that concurrent requests don't garble
+// the terminal.
+func (s *Server) askPassphrase(description, label string) ([]byte, error) {
+	s.promptMu.Lock()
+	defer s.promptMu.Unlock()
+
+	if s.config.Pinentry != "" {
+		return runPinentry(s.config.Pinentry, description, label+":")
+	}
+
+	passphrase, err := readTTYPassphrase(description + "\n" + label + ": ")
+	if errors.Is(err, errNoTerminal) {
+		return nil, fmt.Errorf("the agent has no terminal to ask for the %s; start it with --pinentry", strings.ToLower(label))
+	}
+	return passphrase, err
+}
+
+// askConfirmation asks the human at the agent a yes or no question, with
+// the configured pinentry program or else on the server's terminal
+func (s *Server) askConfirmation(question string) (bool, error) {
+	s.promptMu.Lock()
+	defer s.promptMu.Unlock()
+
+	if s.config.Pinentry != "" {
+		return confirmPinentry(s.config.Pinentry, question)
+	}
+
+	confirmed, err := confirmOnTTY(question)
+	if errors.Is(err, errNoTerminal) {
+		return false, fmt.Errorf("the agent has no terminal to ask for confirmation; start it with --pinentry")
+	}
+	return confirmed, err
+}
+
+// decryptIdentityFile decrypts a passphrase encrypted identity file,
+// asking for the passphrase on the agent side
+func (s *Server) decryptIdentityFile(data []byte, peer string) ([]byte, error) {
+	description := fmt.Sprintf("Enter the passphrase of the age identity file added by %s.", peer)
+
+	for attempt := 1; ; attempt++ {
+		passphrase, err := s.askPassphrase(description, "Passphrase")
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(string(passphrase))
+		wipe(passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		var src io.Reader = bytes.NewReader(data)
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+			src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+		}
+		plaintext, err := age.Decrypt(src, identity)
+		if err == nil {
+			return io.ReadAll(plaintext)
+		}
+
+		var noMatch *age.NoIdentityMatchError
+		if !errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("failed to decrypt identity file: %w", err)
+		}
+		if attempt == passphraseAttempts {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+		description = "Incorrect passphrase, try again."
+	}
+}
+
+// handleAddIdentities answers the add control command. The arguments are
+// constraints followed by base64 encoded identity files, plain or
+// passphrase encrypted.
+func (s *Server) handleAddIdentities(conn net.Conn, args []string) error {
+	opts, files, err := parseAddOptions(args)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+		return err
+	}
+	if len(files) == 0 {
+		conn.Write([]byte("ERROR add requires an identity\n"))
+		return fmt.Errorf("add requires an identity")
+	}
+
+	var identities []*age.X25519Identity
+	for _, file := range files {
+		data, err := base64.StdEncoding.DecodeString(file)
+		if err != nil {
+			conn.Write([]byte("ERROR malformed identity file\n"))
+			return fmt.Errorf("malformed identity file: %w", err)
+		}
+
+		if isEncryptedIdentityFile(data) {
+			data, err = s.decryptIdentityFile(data, describePeer(conn))
+			if err != nil {
+				conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+				return err
+			}
+		}
+
+		parsed, err := parseIdentityFile(data)
+		wipe(data)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR invalid identity file: %v\n", err)))
+			return fmt.Errorf("invalid identity file: %w", err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	added := make([]IdentityInfo, 0, len(identities))
+	for _, identity := range identities {
+		info, isNew, err := s.identities.add(identity, opts)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+			return err
+		}
+		if isNew {
+			logger.Info("identity added", "recipient", info.Recipient, "lifetime", opts.Lifetime,
+				"max_uses", opts.MaxUses, "confirm", opts.Confirm)
+		}
+		added = append(added, info)
+	}
+	return writeControlResponse(conn, added)
+}
+
+// runAdd implements the add subcommand. Encrypted identity files are
+// decrypted by the agent, which asks for their passphrase itself.
+func runAdd(paths []string, opts addOptions) error {
+	args := opts.encode()
+	encrypted := false
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read identity file: %w", err)
+		}
+		if isEncryptedIdentityFile(data) {
+			encrypted = true
+		}
+		args = append(args, base64.StdEncoding.EncodeToString(data))
+		wipe(data)
+	}
+
+	if encrypted {
+		fmt.Fprintln(os.Stderr, "Enter the passphrase on the agent's terminal or pinentry")
+	}
+
+	var added []IdentityInfo
+	if err := dialControl("add", args, &added); err != nil {
+		return err
+	}
+
+	for _, info := range added {
+		fmt.Printf("Identity added: %s\n", info.Recipient)
+	}
+	return nil
+}
+
+// runIdentities implements the identities subcommand
+func runIdentities() error {
+	var identities []IdentityInfo
+	if err := dialControl("identities", nil, &identities); err != nil {
+		return err
+	}
+
+	if len(identities) == 0 {
+		fmt.Println("The agent has no identities")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECIPIENT\tEXPIRES\tUSES\tCONFIRM")
+	for _, info := range identities {
+		expires := "never"
+		if info.Expires != nil {
+			expires = "in " + time.Until(*info.Expires).Round(time.Second).String()
+		}
+		uses := strconv.Itoa(info.Uses)
+		if info.MaxUses > 0 {
+			uses += "/" + strconv.Itoa(info.MaxUses)
+		}
+		confirm := "no"
+		if info.Confirm {
+			confirm = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", info.Recipient, expires, uses, confirm)
+	}
+	return tw.Flush()
+}
+
+// runRemove implements the remove subcommand
+func runRemove(recipient string) error {
+	if err := dialControl("remove", []string{recipient}, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Identity removed: %s\n", recipient)
+	return nil
+}
+
+// runRemoveAll implements the remove-all subcommand
+func runRemoveAll() error {
+	var removed int
+	if err := dialControl("remove-all", nil, &removed); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d identities\n", removed)
+	return nil
+}
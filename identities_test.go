@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func TestIdentityStore(t *testing.T) {
+	store := newIdentityStore()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := identity.Recipient().String()
+
+	if _, added, err := store.add(identity, addOptions{}); err != nil || !added {
+		t.Errorf("expected the first add to store the identity, got added=%v err=%v", added, err)
+	}
+	if _, added, _ := store.add(identity, addOptions{}); added {
+		t.Error("expected adding the same identity again to replace it")
+	}
+	if infos := store.list(); len(infos) != 1 || infos[0].Recipient != recipient {
+		t.Errorf("list() = %v, want one identity for %s", infos, recipient)
+	}
+
+	if err := store.remove("age1doesnotexist"); err == nil {
+		t.Error("expected an error removing an unknown identity")
+	}
+	if err := store.remove(recipient); err != nil {
+		t.Errorf("remove() error = %v", err)
+	}
+	if n := store.removeAll(); n != 0 {
+		t.Errorf("removeAll() = %d, want 0", n)
+	}
+}
+
+func TestIdentityStoreLifetime(t *testing.T) {
+	store := newIdentityStore()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.add(identity, addOptions{Lifetime: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.list()) != 1 {
+		t.Fatal("expected the identity to be held before its lifetime ends")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(store.list()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("identity was not removed after its lifetime ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseAddOptions(t *testing.T) {
+	file := base64.StdEncoding.EncodeToString([]byte("AGE-SECRET-KEY-1X\n"))
+
+	opts, files, err := parseAddOptions([]string{"lifetime=1h", file})
+	if err != nil {
+		t.Fatalf("parseAddOptions() error = %v", err)
+	}
+	if opts.Lifetime != time.Hour || len(files) != 1 || files[0] != file {
+		t.Errorf("parseAddOptions() = %+v, %v", opts, files)
+	}
+	if got := opts.encode(); len(got) != 1 || got[0] != "lifetime=1h0m0s" {
+		t.Errorf("encode() = %v", got)
+	}
+
+	if _, _, err := parseAddOptions([]string{"lifetime=soon", file}); err == nil {
+		t.Error("expected an error for an invalid lifetime")
+	}
+
+	opts, _, err = parseAddOptions([]string{"uses=3", "confirm", file})
+	if err != nil || opts.MaxUses != 3 || !opts.Confirm {
+		t.Errorf("parseAddOptions() = %+v, %v", opts, err)
+	}
+	if _, _, err := parseAddOptions([]string{"uses=0", file}); err == nil {
+		t.Error("expected an error for zero uses")
+	}
+}
+
+func TestAddEncryptedIdentityFile(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypt an identity file with a passphrase, as age -p does
+	recipient, err := age.NewScryptRecipient("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.SetWorkFactor(10)
+	var encrypted bytes.Buffer
+	w, err := age.Encrypt(&encrypted, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("# created: today\n" + identity.String() + "\n"))
+	w.Close()
+
+	pinentry := fakePinentry(t, "correct%20horse", true)
+
+	server := newServer(&Config{Pinentry: pinentry})
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+
+	var added []IdentityInfo
+	args := []string{base64.StdEncoding.EncodeToString(encrypted.Bytes())}
+	if err := performControl(clientConn, "add", args, &added); err != nil {
+		t.Fatalf("add error = %v", err)
+	}
+	if len(added) != 1 || added[0].Recipient != identity.Recipient().String() {
+		t.Errorf("added = %v, want %s", added, identity.Recipient())
+	}
+}
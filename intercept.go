@@ -1,20 +1,148 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+
+	"age-plugin-agent/internal/bech32"
 )
 
-// runIntercept implements the intercept subcommand
-func runIntercept(plugins []string, shell string) error {
-	// Validate plugin names
+// exitCodeError reports that a command run by age-plugin-agent exited
+// unsuccessfully; main exits with the same code
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.code)
+}
+
+// validatePluginNames validates every plugin name in a list
+func validatePluginNames(plugins []string) error {
 	for _, plugin := range plugins {
 		if err := validatePluginName(plugin); err != nil {
 			return fmt.Errorf("invalid plugin name %q: %w", plugin, err)
 		}
 	}
+	return nil
+}
+
+// fileList collects the values of a flag that can be repeated
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// pluginsFromKeyFiles returns the plugins that the identities and recipients
+// in age identity and recipient files use, in order of first appearance.
+// Native X25519 keys need no plugin, and agent keys are already served by
+// the agent.
+func pluginsFromKeyFiles(identityFiles, recipientFiles []string) ([]string, error) {
+	var plugins []string
+	seen := make(map[string]bool)
+
+	collect := func(path string, kind bech32.Kind) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			key, err := bech32.ParseKey(line)
+			if err != nil || key.Kind != kind || key.Plugin == AgentPluginName || seen[key.Plugin] {
+				continue
+			}
+			seen[key.Plugin] = true
+			plugins = append(plugins, key.Plugin)
+		}
+		return nil
+	}
+
+	for _, path := range identityFiles {
+		if err := collect(path, bech32.PluginIdentity); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range recipientFiles {
+		if err := collect(path, bech32.PluginRecipient); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(plugins) == 0 {
+		files := append(append([]string{}, identityFiles...), recipientFiles...)
+		return nil, fmt.Errorf("no plugins referenced in %s", strings.Join(files, ", "))
+	}
+	return plugins, nil
+}
+
+// runInstall implements intercept --install: it creates persistent plugin
+// symlinks in dir, replacing symlinks that already point to this binary
+func runInstall(plugins []string, dir string) error {
+	if err := validatePluginNames(plugins); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create install directory: %w", err)
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	exeInfo, err := os.Stat(exePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat executable: %w", err)
+	}
+
+	for _, plugin := range plugins {
+		linkName := filepath.Join(dir, "age-plugin-"+plugin)
+
+		// Never clobber a real plugin binary or someone else's symlink
+		if info, err := os.Lstat(linkName); err == nil {
+			target, statErr := os.Stat(linkName)
+			if info.Mode()&os.ModeSymlink == 0 || statErr != nil || !os.SameFile(target, exeInfo) {
+				return fmt.Errorf("%s already exists and is not an age-plugin-agent shim", linkName)
+			}
+			if err := os.Remove(linkName); err != nil {
+				return fmt.Errorf("failed to replace symlink for %q: %w", plugin, err)
+			}
+		}
+
+		if err := os.Symlink(exePath, linkName); err != nil {
+			return fmt.Errorf("failed to create symlink for %q: %w", plugin, err)
+		}
+		fmt.Printf("Installed %s\n", linkName)
+	}
+
+	return nil
+}
+
+// runIntercept implements the intercept subcommand. With a command it runs
+// that command instead of an interactive shell and reports its exit status.
+func runIntercept(plugins []string, shell string, command []string) error {
+	// Validate plugin names
+	if err := validatePluginNames(plugins); err != nil {
+		return err
+	}
 
 	// Create temporary directory for symlinks
 	tempDir, err := os.MkdirTemp("", "age-plugin-agent-*")
@@ -59,9 +187,13 @@ func runIntercept(plugins []string, shell string) error {
 		env = append(env, "PATH="+tempDir)
 	}
 
+	if len(command) > 0 {
+		logger.Debug("running command with intercepted plugins", "plugins", plugins, "dir", tempDir, "command", command)
+		return runInterceptedCommand(command, env)
+	}
+
 	// Spawn shell with modified environment
-	fmt.Printf("Starting shell with intercepted plugins: %v\n", plugins)
-	fmt.Printf("Plugin binaries available in: %s\n", tempDir)
+	logger.Info("starting shell with intercepted plugins", "plugins", plugins, "dir", tempDir)
 
 	cmd := exec.Command(shell)
 	cmd.Stdin = os.Stdin
@@ -75,3 +207,45 @@ func runIntercept(plugins []string, shell string) error {
 
 	return nil
 }
+
+// runInterceptedCommand runs a command with the intercepting environment,
+// forwarding termination signals to it
+func runInterceptedCommand(command []string, env []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+
+	// Catch signals before starting so that we outlive the command and can
+	// clean up the symlink directory
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigChan)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+
+	go func() {
+		for sig := range sigChan {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("command failed: %w", err)
+	}
+
+	// Report death by signal the way shells do
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &exitCodeError{code: 128 + int(status.Signal())}
+	}
+	return &exitCodeError{code: exitErr.ExitCode()}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunInterceptCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  []string
+		wantCode int
+	}{
+		{
+			name:     "successful command sees the shim",
+			command:  []string{"sh", "-c", "command -v age-plugin-test >/dev/null"},
+			wantCode: 0,
+		},
+		{
+			name:     "exit code is propagated",
+			command:  []string{"sh", "-c", "exit 3"},
+			wantCode: 3,
+		},
+		{
+			name:     "death by signal",
+			command:  []string{"sh", "-c", "kill -TERM $$"},
+			wantCode: 143,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runIntercept([]string{"test"}, "", tt.command)
+
+			code := 0
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				code = exitErr.code
+			} else if err != nil {
+				t.Fatalf("runIntercept() error = %v", err)
+			}
+
+			if code != tt.wantCode {
+				t.Errorf("runIntercept() exit code = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRunInstall(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := runInstall([]string{"yubikey", "tpm"}, dir); err != nil {
+		t.Fatalf("runInstall() error = %v", err)
+	}
+
+	// Installing again replaces our own symlinks
+	if err := runInstall([]string{"yubikey"}, dir); err != nil {
+		t.Errorf("runInstall() over existing shims error = %v", err)
+	}
+
+	// A real plugin binary must never be replaced
+	realPlugin := filepath.Join(dir, "age-plugin-real")
+	if err := os.WriteFile(realPlugin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+	if err := runInstall([]string{"real"}, dir); err == nil {
+		t.Errorf("runInstall() should refuse to replace %s", realPlugin)
+	}
+}
+
+func TestPluginsFromKeyFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities string
+		recipients string
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name: "plugin identities in order",
+			identities: "# created: 2026-01-01\n" +
+				"AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TX\n" +
+				"AGE-SECRET-KEY-1QFLFNLPJDU6RYGJ07J742YUZ83PCY4DHFJ65LR6KXQ8MX7R2QJ4QF6VD7Y\n" +
+				"  AGE-PLUGIN-FAKE-1WDKX7AP3TH4AM6  \n" +
+				"AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TX\n",
+			want: []string{"yubikey", "fake"},
+		},
+		{
+			name:       "agent identities are skipped",
+			identities: "AGE-PLUGIN-AGENT-1F8KQKC\nAGE-PLUGIN-FAKE-1WDKX7AP3TH4AM6\n",
+			want:       []string{"fake"},
+		},
+		{
+			name: "plugin recipients",
+			recipients: "# team\n" +
+				"age16f4z20zl582u080p8ve3t8v343da5x7cd72fhl5gxl4vur83hu5qnlp7u2\n" +
+				"age1yubikey1qypqxl3v7vr\n" +
+				"age1agent1w3jkzmfdwpex7eqpngfsg\n" +
+				"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN\n",
+			want: []string{"yubikey"},
+		},
+		{
+			name:       "identities and recipients together",
+			identities: "AGE-PLUGIN-FAKE-1WDKX7AP3TH4AM6\n",
+			recipients: "age1yubikey1qypqxl3v7vr\n",
+			want:       []string{"fake", "yubikey"},
+		},
+		{
+			name:       "recipients in an identity file are ignored",
+			identities: "age1yubikey1qypqxl3v7vr\n",
+			wantErr:    true,
+		},
+		{
+			name:       "native identities only",
+			identities: "AGE-SECRET-KEY-1QFLFNLPJDU6RYGJ07J742YUZ83PCY4DHFJ65LR6KXQ8MX7R2QJ4QF6VD7Y\n",
+			wantErr:    true,
+		},
+		{
+			name:       "bad checksum",
+			identities: "AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TY\n",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var identityFiles, recipientFiles []string
+			if tt.identities != "" {
+				path := filepath.Join(dir, "identities.txt")
+				if err := os.WriteFile(path, []byte(tt.identities), 0600); err != nil {
+					t.Fatal(err)
+				}
+				identityFiles = append(identityFiles, path)
+			}
+			if tt.recipients != "" {
+				path := filepath.Join(dir, "recipients.txt")
+				if err := os.WriteFile(path, []byte(tt.recipients), 0600); err != nil {
+					t.Fatal(err)
+				}
+				recipientFiles = append(recipientFiles, path)
+			}
+
+			got, err := pluginsFromKeyFiles(identityFiles, recipientFiles)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pluginsFromKeyFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pluginsFromKeyFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPluginsFromKeyFilesMissing(t *testing.T) {
+	if _, err := pluginsFromKeyFiles([]string{filepath.Join(t.TempDir(), "missing.txt")}, nil); err == nil {
+		t.Error("pluginsFromKeyFiles() succeeded for a missing file")
+	}
+}
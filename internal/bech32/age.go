@@ -0,0 +1,100 @@
+package bech32
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// RecipientHRP is the human-readable part of native X25519 recipients
+	RecipientHRP = "age"
+	// SecretKeyHRP is the human-readable part of native X25519 identities
+	SecretKeyHRP = "AGE-SECRET-KEY-"
+
+	pluginRecipientPrefix = "age1"
+	pluginIdentityPrefix  = "AGE-PLUGIN-"
+)
+
+// Kind is the kind of an age key string
+type Kind int
+
+const (
+	// X25519Recipient is a native age1... recipient
+	X25519Recipient Kind = iota + 1
+	// X25519Identity is a native AGE-SECRET-KEY-1... identity
+	X25519Identity
+	// PluginRecipient is an age1<name>1... plugin recipient
+	PluginRecipient
+	// PluginIdentity is an AGE-PLUGIN-<NAME>-1... plugin identity
+	PluginIdentity
+)
+
+// Key is a decoded age recipient or identity string
+type Key struct {
+	Kind Kind
+	// Plugin is the lowercase plugin name of plugin keys
+	Plugin string
+	// Data is the key material or plugin data
+	Data []byte
+}
+
+// ParseKey decodes an age recipient or identity string
+func ParseKey(s string) (*Key, error) {
+	hrp, data, err := Decode(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hrp == RecipientHRP:
+		if s != strings.ToLower(s) {
+			return nil, errors.New("recipient is not lowercase")
+		}
+		return &Key{Kind: X25519Recipient, Data: data}, nil
+	case hrp == strings.ToLower(SecretKeyHRP):
+		if s != strings.ToUpper(s) {
+			return nil, errors.New("identity is not uppercase")
+		}
+		return &Key{Kind: X25519Identity, Data: data}, nil
+	case strings.HasPrefix(hrp, pluginRecipientPrefix):
+		if s != strings.ToLower(s) {
+			return nil, errors.New("recipient is not lowercase")
+		}
+		name := strings.TrimPrefix(hrp, pluginRecipientPrefix)
+		if name == "" {
+			return nil, errors.New("empty plugin name")
+		}
+		return &Key{Kind: PluginRecipient, Plugin: name, Data: data}, nil
+	case strings.HasPrefix(hrp, strings.ToLower(pluginIdentityPrefix)) && strings.HasSuffix(hrp, "-"):
+		if s != strings.ToUpper(s) {
+			return nil, errors.New("identity is not uppercase")
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(hrp, strings.ToLower(pluginIdentityPrefix)), "-")
+		if name == "" {
+			return nil, errors.New("empty plugin name")
+		}
+		return &Key{Kind: PluginIdentity, Plugin: name, Data: data}, nil
+	default:
+		return nil, errors.New("not an age recipient or identity")
+	}
+}
+
+// PluginName extracts the plugin name from a plugin recipient or identity.
+// It returns false for native X25519 keys and anything that does not decode.
+func PluginName(s string) (string, bool) {
+	key, err := ParseKey(s)
+	if err != nil || key.Plugin == "" {
+		return "", false
+	}
+	return key.Plugin, true
+}
+
+// EncodePluginIdentity encodes an AGE-PLUGIN-<NAME>-1... identity
+func EncodePluginIdentity(name string, data []byte) (string, error) {
+	return Encode(pluginIdentityPrefix+strings.ToUpper(name)+"-", data)
+}
+
+// EncodePluginRecipient encodes an age1<name>1... recipient
+func EncodePluginRecipient(name string, data []byte) (string, error) {
+	return Encode(pluginRecipientPrefix+strings.ToLower(name), data)
+}
@@ -0,0 +1,167 @@
+package bech32
+
+import (
+	"bytes"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+const (
+	testRecipient = "age16f4z20zl582u080p8ve3t8v343da5x7cd72fhl5gxl4vur83hu5qnlp7u2"
+	testIdentity  = "AGE-SECRET-KEY-1QFLFNLPJDU6RYGJ07J742YUZ83PCY4DHFJ65LR6KXQ8MX7R2QJ4QF6VD7Y"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		s          string
+		wantKind   Kind
+		wantPlugin string
+		wantData   []byte
+		wantErr    bool
+	}{
+		{"x25519 recipient", testRecipient, X25519Recipient, "", nil, false},
+		{"x25519 identity", testIdentity, X25519Identity, "", nil, false},
+		{"plugin recipient", "age1yubikey1qypqxl3v7vr", PluginRecipient, "yubikey", []byte{1, 2, 3}, false},
+		{"plugin identity", "AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TX", PluginIdentity, "yubikey", []byte{1, 2, 3}, false},
+		{"agent identity", "AGE-PLUGIN-AGENT-1F8KQKC", PluginIdentity, "agent", []byte{}, false},
+		{"agent recipient", "age1agent1w3jkzmfdwpex7eqpngfsg", PluginRecipient, "agent", []byte("team-prod"), false},
+		{"uppercase recipient", "AGE1YUBIKEY1QYPQXL3V7VR", 0, "", nil, true},
+		{"lowercase identity", "age-plugin-yubikey-1qypqx3he0tx", 0, "", nil, true},
+		{"bad checksum", "AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TY", 0, "", nil, true},
+		{"empty plugin name identity", mustEncode(t, "AGE-PLUGIN--", []byte{1}), 0, "", nil, true},
+		{"other bech32 string", "a12uel5l", 0, "", nil, true},
+		{"not bech32", "ssh-ed25519 AAAA", 0, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKey(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if key.Kind != tt.wantKind || key.Plugin != tt.wantPlugin {
+				t.Errorf("ParseKey() = kind %d, plugin %q, want kind %d, plugin %q", key.Kind, key.Plugin, tt.wantKind, tt.wantPlugin)
+			}
+			if tt.wantData != nil && !bytes.Equal(key.Data, tt.wantData) {
+				t.Errorf("ParseKey() data = %x, want %x", key.Data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestPluginName(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   string
+		wantOK bool
+	}{
+		{"AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TX", "yubikey", true},
+		{"age1yubikey1qypqxl3v7vr", "yubikey", true},
+		{"AGE-PLUGIN-AGENT-1F8KQKC", "agent", true},
+		{testRecipient, "", false},
+		{testIdentity, "", false},
+		{"AGE-PLUGIN-YUBIKEY-1", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, ok := PluginName(tt.s)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("PluginName() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestX25519AgainstAge(t *testing.T) {
+	// The fixed pair was produced by age-keygen
+	identity, err := age.ParseX25519Identity(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Recipient().String() != testRecipient {
+		t.Fatalf("test vector mismatch: %s", identity.Recipient())
+	}
+
+	for i := 0; i < 32; i++ {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range []string{identity.String(), identity.Recipient().String()} {
+			hrp, data, err := Decode(s)
+			if err != nil {
+				t.Fatalf("Decode(%q) error = %v", s, err)
+			}
+			if len(data) != 32 {
+				t.Fatalf("Decode(%q) data length = %d, want 32", s, len(data))
+			}
+			if hrp == "age" {
+				hrp = RecipientHRP
+			} else {
+				hrp = SecretKeyHRP
+			}
+			encoded, err := Encode(hrp, data)
+			if err != nil || encoded != s {
+				t.Errorf("Encode() = %q, %v, want %q", encoded, err, s)
+			}
+		}
+	}
+}
+
+func TestPluginKeysAgainstAge(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"yubikey", []byte{1, 2, 3}},
+		{"agent", nil},
+		{"agent", []byte("team-prod")},
+		{"se", bytes.Repeat([]byte{0xff}, 65)},
+		{"tpm", []byte("x")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := EncodePluginIdentity(tt.name, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := plugin.EncodeIdentity(tt.name, tt.data); identity != want {
+				t.Errorf("EncodePluginIdentity() = %q, want %q", identity, want)
+			}
+
+			recipient, err := EncodePluginRecipient(tt.name, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := plugin.EncodeRecipient(tt.name, tt.data); recipient != want {
+				t.Errorf("EncodePluginRecipient() = %q, want %q", recipient, want)
+			}
+
+			for _, s := range []string{identity, recipient} {
+				name, ok := PluginName(s)
+				if !ok || name != tt.name {
+					t.Errorf("PluginName(%q) = %q, %v, want %q", s, name, ok, tt.name)
+				}
+			}
+		})
+	}
+}
+
+func mustEncode(t *testing.T, hrp string, data []byte) string {
+	t.Helper()
+	s, err := Encode(hrp, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+// Package bech32 implements the Bech32 encoding used by age for recipients,
+// identities and plugin keys, as specified in BIP 173 but without its
+// 90 character length limit.
+package bech32
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// charset is the Bech32 data alphabet
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// generator holds the coefficients of the BCH checksum polynomial
+var generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// polymod computes the BCH checksum of values
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// hrpExpand expands the human-readable part for checksum computation
+func hrpExpand(hrp string) []byte {
+	h := []byte(strings.ToLower(hrp))
+	ret := make([]byte, 0, len(h)*2+1)
+	for _, c := range h {
+		ret = append(ret, c>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range h {
+		ret = append(ret, c&31)
+	}
+	return ret
+}
+
+// verifyChecksum reports whether data ends with a valid checksum for hrp
+func verifyChecksum(hrp string, data []byte) bool {
+	return polymod(append(hrpExpand(hrp), data...)) == 1
+}
+
+// createChecksum returns the six checksum values for hrp and data
+func createChecksum(hrp string, data []byte) []byte {
+	values := append(hrpExpand(hrp), data...)
+	values = append(values, []byte{0, 0, 0, 0, 0, 0}...)
+	mod := polymod(values) ^ 1
+	ret := make([]byte, 6)
+	for p := range ret {
+		ret[p] = byte(mod>>uint(5*(5-p))) & 31
+	}
+	return ret
+}
+
+// convertBits regroups data from frombits-bit to tobits-bit values
+func convertBits(data []byte, frombits, tobits byte, pad bool) ([]byte, error) {
+	var ret []byte
+	acc := uint32(0)
+	bits := byte(0)
+	maxv := byte(1<<tobits - 1)
+	for idx, value := range data {
+		if value>>frombits != 0 {
+			return nil, fmt.Errorf("invalid data range: data[%d]=%d (frombits=%d)", idx, value, frombits)
+		}
+		acc = acc<<frombits | uint32(value)
+		bits += frombits
+		for bits >= tobits {
+			bits -= tobits
+			ret = append(ret, byte(acc>>bits)&maxv)
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(tobits-bits))&maxv)
+		}
+	} else if bits >= frombits {
+		return nil, errors.New("illegal zero padding")
+	} else if byte(acc<<(tobits-bits))&maxv != 0 {
+		return nil, errors.New("non-zero padding")
+	}
+	return ret, nil
+}
+
+// Encode encodes data with the human-readable part hrp. The result is
+// uppercase if hrp is uppercase, and lowercase otherwise.
+func Encode(hrp string, data []byte) (string, error) {
+	if len(hrp) < 1 {
+		return "", errors.New("empty human-readable part")
+	}
+	for p, c := range hrp {
+		if c < 33 || c > 126 {
+			return "", fmt.Errorf("invalid human-readable part character: hrp[%d]=%d", p, c)
+		}
+	}
+	if strings.ToUpper(hrp) != hrp && strings.ToLower(hrp) != hrp {
+		return "", fmt.Errorf("mixed case human-readable part: %q", hrp)
+	}
+	lower := strings.ToLower(hrp) == hrp
+
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	var ret strings.Builder
+	ret.WriteString(strings.ToLower(hrp))
+	ret.WriteString("1")
+	for _, v := range values {
+		ret.WriteByte(charset[v])
+	}
+	for _, v := range createChecksum(hrp, values) {
+		ret.WriteByte(charset[v])
+	}
+
+	if lower {
+		return ret.String(), nil
+	}
+	return strings.ToUpper(ret.String()), nil
+}
+
+// Decode decodes a Bech32 string into its lowercase human-readable part
+// and data
+func Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, fmt.Errorf("separator '1' at invalid position: pos=%d, len=%d", pos, len(s))
+	}
+
+	hrp := strings.ToLower(s[:pos])
+	for p, c := range hrp {
+		if c < 33 || c > 126 {
+			return "", nil, fmt.Errorf("invalid character human-readable part: s[%d]=%d", p, c)
+		}
+	}
+
+	s = strings.ToLower(s)
+	values := make([]byte, 0, len(s)-pos-1)
+	for p, c := range s[pos+1:] {
+		d := strings.IndexRune(charset, c)
+		if d == -1 {
+			return "", nil, fmt.Errorf("invalid character data part: s[%d]=%v", pos+1+p, c)
+		}
+		values = append(values, byte(d))
+	}
+	if !verifyChecksum(hrp, values) {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
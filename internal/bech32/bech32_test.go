@@ -0,0 +1,151 @@
+package bech32
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Test vectors from BIP 173. All of them happen to regroup into whole bytes,
+// so they decode without padding errors.
+func TestDecodeValid(t *testing.T) {
+	tests := []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+		"?1ezyfcl",
+	}
+
+	for _, s := range tests {
+		t.Run(s, func(t *testing.T) {
+			lower := strings.ToLower(s)
+			pos := strings.LastIndex(lower, "1")
+			var values []byte
+			for _, c := range lower[pos+1:] {
+				values = append(values, byte(strings.IndexRune(charset, c)))
+			}
+			if !verifyChecksum(lower[:pos], values) {
+				t.Errorf("verifyChecksum() = false, want true")
+			}
+
+			hrp, data, err := Decode(s)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			encoded, err := Encode(hrp, data)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if encoded != strings.ToLower(s) {
+				t.Errorf("Encode() = %q, want %q", encoded, strings.ToLower(s))
+			}
+		})
+	}
+}
+
+// Test vectors from BIP 173, except the one for the length limit age lifts
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"hrp character out of range (space)", "\x201nwldj5"},
+		{"hrp character out of range (DEL)", "\x7f1axkwrx"},
+		{"hrp character out of range (non-ASCII)", "\x801eym55h"},
+		{"no separator", "pzry9x0s0muk"},
+		{"empty hrp", "1pzry9x0s0muk"},
+		{"invalid data character", "x1b4n0q5v"},
+		{"too short checksum", "li1dgmt3"},
+		{"invalid character in checksum", "de1lg7wt\xff"},
+		{"checksum calculated with uppercase hrp", "A1G7SGD8"},
+		{"empty hrp with data", "10a06t8"},
+		{"empty hrp with checksum only", "1qzzfhee"},
+		{"mixed case", "A12uEL5L"},
+		{"bad checksum", "a12uel5m"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := Decode(tt.s); err == nil {
+				t.Errorf("Decode(%q) succeeded, want error", tt.s)
+			}
+		})
+	}
+}
+
+func TestDecodeLongStrings(t *testing.T) {
+	// age keys are not subject to the 90 character limit of BIP 173
+	data := bytes.Repeat([]byte{0xa5}, 200)
+	encoded, err := Encode("AGE-PLUGIN-LONG-", data)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if len(encoded) <= 90 {
+		t.Fatalf("encoded length = %d, want over 90", len(encoded))
+	}
+
+	hrp, decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if hrp != "age-plugin-long-" || !bytes.Equal(decoded, data) {
+		t.Errorf("Decode() = %q, %x", hrp, decoded)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		hrp     string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"lowercase", "a", nil, "a12uel5l", false},
+		{"uppercase", "A", nil, "A12UEL5L", false},
+		{"plugin identity", "AGE-PLUGIN-YUBIKEY-", []byte{1, 2, 3}, "AGE-PLUGIN-YUBIKEY-1QYPQX3HE0TX", false},
+		{"plugin recipient", "age1yubikey", []byte{1, 2, 3}, "age1yubikey1qypqxl3v7vr", false},
+		{"empty hrp", "", []byte{1}, "", true},
+		{"mixed case hrp", "Age", []byte{1}, "", true},
+		{"hrp character out of range", "a b", []byte{1}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.hrp, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Encode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Encode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for n := 0; n < 64; n++ {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i*31 + n)
+		}
+
+		for _, hrp := range []string{"age", "AGE-SECRET-KEY-"} {
+			encoded, err := Encode(hrp, data)
+			if err != nil {
+				t.Fatalf("Encode(%q, %d bytes) error = %v", hrp, n, err)
+			}
+			gotHRP, got, err := Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode(%q) error = %v", encoded, err)
+			}
+			if gotHRP != strings.ToLower(hrp) || !bytes.Equal(got, data) {
+				t.Errorf("round trip of %d bytes with %q = %q, %x", n, hrp, gotHRP, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// lockHashIterations is the PBKDF2 work factor for the lock passphrase
+	lockHashIterations = 600000
+	// lockSaltSize is the size of the random salt mixed into the lock passphrase hash
+	lockSaltSize = 16
+	// lockHashSize is the size of the lock passphrase hash
+	lockHashSize = 32
+	// unlockFailureDelay is how much longer the agent waits after each
+	// failed unlock attempt in a row, like ssh-agent
+	unlockFailureDelay = 100 * time.Millisecond
+	// maxUnlockFailureDelay caps the wait after a failed unlock attempt
+	maxUnlockFailureDelay = 10 * time.Second
+)
+
+// agentLock holds the lock state of the server. The passphrase is only kept
+// as a salted PBKDF2 hash.
+type agentLock struct {
+	mu           sync.Mutex
+	locked       bool
+	salt         []byte
+	hash         []byte
+	lastActivity time.Time
+
+	// attempt serializes unlock attempts, so that concurrent connections
+	// can't sidestep the delay after failures
+	attempt  sync.Mutex
+	failures int
+}
+
+// newAgentLock creates an unlocked agent lock with no passphrase set
+func newAgentLock() *agentLock {
+	return &agentLock{lastActivity: time.Now()}
+}
+
+// isLocked reports whether the agent is locked
+func (l *agentLock) isLocked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.locked
+}
+
+// lock locks the agent with the given passphrase
+func (l *agentLock) lock(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("passphrase cannot be empty")
+	}
+
+	salt := make([]byte, lockSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	hash := pbkdf2.Key(passphrase, salt, lockHashIterations, lockHashSize, sha256.New)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked {
+		return fmt.Errorf("agent already locked")
+	}
+	l.locked = true
+	l.salt = salt
+	l.hash = hash
+	return nil
+}
+
+// relock locks the agent again with the passphrase of the last lock command.
+// It returns false if no passphrase has been set yet.
+func (l *agentLock) relock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hash == nil {
+		return false
+	}
+	l.locked = true
+	return true
+}
+
+// unlock unlocks the agent if the passphrase matches the one it was locked with.
+// The hash is kept so that automatic locking can engage again later. Failed
+// attempts are answered with a growing delay, to slow down guessing.
+func (l *agentLock) unlock(passphrase []byte) error {
+	l.attempt.Lock()
+	defer l.attempt.Unlock()
+
+	l.mu.Lock()
+	salt, hash, locked := l.salt, l.hash, l.locked
+	l.mu.Unlock()
+
+	if !locked {
+		return fmt.Errorf("agent not locked")
+	}
+
+	// Hash outside the mutex so a slow unlock attempt doesn't block other connections
+	candidate := pbkdf2.Key(passphrase, salt, lockHashIterations, lockHashSize, sha256.New)
+	if subtle.ConstantTimeCompare(candidate, hash) != 1 {
+		l.failures++
+		time.Sleep(unlockDelay(l.failures))
+		return fmt.Errorf("incorrect passphrase")
+	}
+	l.failures = 0
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.locked = false
+	l.lastActivity = time.Now()
+	return nil
+}
+
+// unlockDelay returns how long to wait after the given number of failed
+// unlock attempts in a row
+func unlockDelay(failures int) time.Duration {
+	delay := time.Duration(failures) * unlockFailureDelay
+	if delay > maxUnlockFailureDelay {
+		return maxUnlockFailureDelay
+	}
+	return delay
+}
+
+// touch records activity for the idle timer
+func (l *agentLock) touch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastActivity = time.Now()
+}
+
+// idleSince returns the time of the last recorded activity
+func (l *agentLock) idleSince() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastActivity
+}
+
+// watchIdle locks the agent once no session has been active for the given
+// duration. It runs until the process exits.
+func (s *Server) watchIdle(idle time.Duration) {
+	interval := idle / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		if s.lock.isLocked() || len(s.sessions.list()) > 0 {
+			continue
+		}
+		if time.Since(s.lock.idleSince()) < idle {
+			continue
+		}
+		if s.lock.relock() {
+			logger.Info("agent locked after inactivity", "idle", idle)
+		}
+	}
+}
+
+// watchLockCommand runs a hook command and locks the agent every time it
+// prints a line, e.g. a screen saver monitor. It runs until the command exits.
+func (s *Server) watchLockCommand(command string) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logger.Error("lock command error", "err", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		logger.Error("lock command error", "err", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if s.lock.relock() {
+			logger.Info("agent locked by lock command")
+		} else {
+			logger.Warn("lock command fired but no lock passphrase has been set")
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		logger.Warn("lock command exited", "err", err)
+	}
+}
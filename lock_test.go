@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentLock(t *testing.T) {
+	lock := newAgentLock()
+
+	if lock.relock() {
+		t.Errorf("relock() without a passphrase should not lock")
+	}
+	if err := lock.unlock([]byte("secret")); err == nil {
+		t.Errorf("unlock() of unlocked agent should fail")
+	}
+	if err := lock.lock(nil); err == nil {
+		t.Errorf("lock() with empty passphrase should fail")
+	}
+
+	if err := lock.lock([]byte("secret")); err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+	if !lock.isLocked() {
+		t.Fatalf("agent should be locked")
+	}
+	if err := lock.unlock([]byte("wrong")); err == nil || !strings.Contains(err.Error(), "incorrect passphrase") {
+		t.Errorf("unlock() with wrong passphrase error = %v, want incorrect passphrase", err)
+	}
+	if err := lock.unlock([]byte("secret")); err != nil {
+		t.Fatalf("unlock() error = %v", err)
+	}
+	if lock.isLocked() {
+		t.Fatalf("agent should be unlocked")
+	}
+
+	if !lock.relock() || !lock.isLocked() {
+		t.Errorf("relock() should lock again with the last passphrase")
+	}
+}
+
+func TestUnlockDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{5, 500 * time.Millisecond},
+		{100, maxUnlockFailureDelay},
+		{1000, maxUnlockFailureDelay},
+	}
+
+	for _, tt := range tests {
+		if got := unlockDelay(tt.failures); got != tt.want {
+			t.Errorf("unlockDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestPerformServerHandshakeLocked(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantErr  bool
+		response string
+	}{
+		{
+			name:     "plugin session rejected",
+			line:     "yubikey\n",
+			wantErr:  true,
+			response: "ERROR agent locked\n",
+		},
+		{
+			name:     "control command rejected",
+			line:     "@sessions\n",
+			wantErr:  true,
+			response: "ERROR agent locked\n",
+		},
+		{
+			name:    "unlock allowed",
+			line:    "@unlock c2VjcmV0\n",
+			wantErr: false,
+		},
+	}
+
+	server := newServer(&Config{SocketPath: "/test/agent.sock"})
+	server.lock.locked = true
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+
+			go clientConn.Write([]byte(tt.line))
+
+			response := make(chan string, 1)
+			go func() {
+				buf := make([]byte, 64)
+				n, _ := clientConn.Read(buf)
+				response <- string(buf[:n])
+			}()
+
+			_, err := server.performServerHandshake(serverConn)
+			serverConn.Close()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("performServerHandshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := <-response; got != tt.response {
+				t.Errorf("server response = %q, want %q", got, tt.response)
+			}
+		})
+	}
+}
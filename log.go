@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger is the process-wide structured logger. Commands log to stderr at
+// info level unless the server flags or the client debug file change that.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// parseLogLevel parses a level name: debug, info, warn or error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+// newLogger creates a logger writing records at or above level to w, in
+// the "text" or "json" format
+func newLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+}
+
+// openLogFile opens a log file for appending, creating it private to the user
+func openLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return file, nil
+}
+
+// setupLogging replaces the process-wide logger. An empty path logs to
+// stderr. The log file stays open for the life of the process.
+func setupLogging(levelName, format, path string) error {
+	level, err := parseLogLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stderr
+	if path != "" {
+		file, err := openLogFile(path)
+		if err != nil {
+			return err
+		}
+		w = file
+	}
+
+	l, err := newLogger(w, level, format)
+	if err != nil {
+		return err
+	}
+	logger = l
+	return nil
+}
+
+// setupClientLogging configures logging for proxy mode. age shows whatever
+// a plugin writes to stderr to the user, so the proxy stays silent unless
+// AGE_PLUGIN_AGENT_DEBUG names a file to write debug logs to.
+func setupClientLogging() {
+	path := os.Getenv(DebugEnvVar)
+	if path == "" {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		return
+	}
+
+	if err := setupLogging("debug", "text", path); err != nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+}
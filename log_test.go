@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    slog.Level
+		wantErr bool
+	}{
+		{name: "debug", want: slog.LevelDebug},
+		{name: "info", want: slog.LevelInfo},
+		{name: "WARN", want: slog.LevelWarn},
+		{name: "error", want: slog.LevelError},
+		{name: "verbose", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLogLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLogLevel(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseLogLevel(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, slog.LevelInfo, "json")
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+
+	l.Debug("hidden")
+	l.With("session", 7).Info("plugin started", "pid", 42)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "plugin started" || record["session"] != float64(7) || record["pid"] != float64(42) {
+		t.Errorf("unexpected record: %v", record)
+	}
+
+	if _, err := newLogger(&buf, slog.LevelInfo, "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestSetupClientLogging(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+
+	path := filepath.Join(t.TempDir(), "debug.log")
+	t.Setenv(DebugEnvVar, path)
+	setupClientLogging()
+	logger.Debug("proxy started", "plugin", "yubikey")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read debug log: %v", err)
+	}
+	if !strings.Contains(string(data), "proxy started") || !strings.Contains(string(data), "plugin=yubikey") {
+		t.Errorf("debug log missing record: %q", data)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// Version is the release version of age-plugin-agent
+const Version = "0.1.0"
+
 // getPluginNameFromBinaryName extracts plugin name from binary path
 // Returns the plugin name and true if this is a plugin-named binary
 func getPluginNameFromBinaryName(binaryPath string) (string, bool) {
@@ -25,22 +30,169 @@ func getPluginNameFromBinaryName(binaryPath string) (string, bool) {
 	return "", false
 }
 
+// isOwnExecutable reports whether info describes this executable, which is
+// the case for intercept shims since they are symlinks to it
+func isOwnExecutable(info os.FileInfo) bool {
+	exePath, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	exeInfo, err := os.Stat(exePath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(info, exeInfo)
+}
+
 func printUsage() {
 	fmt.Fprintf(os.Stderr, `age-plugin-agent - Age plugin proxy agent
 
 Usage:
   age-plugin-agent intercept <plugin1>[,plugin2,...] [shell]
-  age-plugin-agent proxy <plugin-name>
-  age-plugin-agent server [socket-path]
+  age-plugin-agent intercept <plugin1>[,plugin2,...] -- <command> [args...]
+  age-plugin-agent intercept --install <dir> <plugin1>[,plugin2,...]
+  age-plugin-agent intercept [--identities <file>]... [--recipients <file>]... [shell | -- <command> [args...]]
+  age-plugin-agent shell-init bash|zsh|fish [dir]
+  age-plugin-agent proxy <plugin-name> [plugin-args...]
+  age-plugin-agent server [--config <file>] [--replace] [--lock-idle <duration>] [--lock-command <cmd>]
+                          [--pinentry <program>]
+                          [--log-level <level>] [--log-format <format>] [--log-file <file>] [socket-path]
+  age-plugin-agent status
+  age-plugin-agent list
+  age-plugin-agent sessions
+  age-plugin-agent cancel <session-id>
+  age-plugin-agent lock
+  age-plugin-agent unlock
+  age-plugin-agent add [-t <duration>] [-n <uses>] [-c] <identity-file>...
+  age-plugin-agent identities
+  age-plugin-agent remove <recipient>
+  age-plugin-agent remove-all
+  age-plugin-agent groups
+  age-plugin-agent identity-stub <plugin-name> [identity-file]
+  age-plugin-agent pin [-d] <plugin-name>
+  age-plugin-agent doctor [plugin-name]
   age-plugin-agent --help
 
 Commands:
-  intercept   Create a shell with specified plugins intercepted
+  intercept   Create a shell, or run a command, with specified plugins intercepted.
+              --identities and --recipients intercept exactly the plugins
+              referenced by the AGE-PLUGIN-... identities and age1<plugin>1...
+              recipients in the given files instead; both can be repeated
+  shell-init  Print shell code that puts installed plugin symlinks on PATH
+              (dir defaults to ~/.local/share/age-plugin-agent/bin) and
+              exports AGE_PLUGIN_AGENT_SOCKET if it is set. Otherwise the
+              shims search for a working agent socket each time they run
   proxy       Connect to server and proxy stdin/stdout for a plugin
   server      Start the agent server listening on a Unix socket
+  status      Show the state of the running server and its sessions
+  list        List the plugins available on the server
+  sessions    List the plugin sessions running on the server
+  cancel      Terminate a running plugin session
+  lock        Lock the agent with a passphrase, rejecting all plugin requests
+  unlock      Unlock the agent
+  add         Load the X25519 identities in an age identity file into the
+              agent, to decrypt with age -d -j agent. The agent asks for
+              the passphrase of encrypted files on its own terminal or
+              pinentry. -t removes them again after the given duration,
+              -n after unwrapping that many file keys. -c asks on the agent
+              before every use. Keys are kept in locked memory, but
+              copies made while loading and using them stay in ordinary
+              memory until it is reused.
+  identities  List the identities held by the agent with their limits
+  remove      Remove the identity with the given recipient from the agent
+  remove-all  Remove all identities from the agent, including those held
+              for identity stubs
+  groups      List the recipient groups defined on the agent, with the
+              age1agent1... recipient that encrypts to each of them
+  identity-stub
+              Print an AGE-PLUGIN-AGENT-1... identity that decrypts with a
+              plugin on the agent. With an identity file, the agent holds
+              the plugin identities in it in locked memory until it exits
+              or remove-all, and the stubs refer to them; without, the
+              plugin's default identity is used
+  pin         Have the agent answer the plugin's PIN requests that match
+              secret_prompts. The PIN is asked for on the agent's terminal
+              or with --pinentry, so that it is never typed at the client.
+              -d forgets the PIN again.
+  doctor      Diagnose the socket, server and interception setup
 
 Environment Variables:
-  AGE_PLUGIN_AGENT_SOCKET   Path to Unix domain socket (default: ~/.age-plugin-agent.sock)
+  AGE_PLUGIN_AGENT_SOCKET   Path to Unix domain socket (default:
+                            $XDG_RUNTIME_DIR/age-plugin-agent/agent.sock, or
+                            /tmp/age-plugin-agent-<uid>/agent.sock).
+                            Clients accept a colon-separated list and then also
+                            try $XDG_RUNTIME_DIR/age-plugin-agent/*.sock and
+                            ~/.age-plugin-agent*.sock, using the first agent
+                            that accepts the plugin
+  AGE_PLUGIN_AGENT_FALLBACK Set to "local" to run the real plugin from PATH when
+                            the agent is unreachable or doesn't have the plugin
+  AGE_PLUGIN_AGENT_RETRY_TIMEOUT
+                            Keep retrying for this long (e.g. 10s) while the
+                            socket is missing or refuses connections, before
+                            any plugin data is exchanged
+  AGE_PLUGIN_AGENT_DEBUG    Append proxy debug logs to this file; age owns the
+                            proxy's stdout and shows its stderr to the user
+
+Server Options:
+  --config <file>          JSON configuration file
+                           (default: ~/.config/age-plugin-agent/config.json)
+  --replace                Shut down an agent already listening on the socket
+                           instead of refusing to start
+  --lock-idle <duration>   Lock again with the last lock passphrase after this
+                           long without sessions (e.g. 15m)
+  --lock-command <cmd>     Run <cmd> with /bin/sh and lock again with the last
+                           lock passphrase whenever it prints a line
+  --pinentry <program>     Ask for the passphrases of encrypted identity files
+                           and for PINs with this pinentry program instead of
+                           the terminal
+  --log-level <level>      Minimum level to log: debug, info, warn or error
+                           (default: info)
+  --log-format <format>    Log format: text or json (default: text)
+  --log-file <file>        Append logs to <file> instead of stderr
+
+Server Configuration File:
+  {
+    "upstreams": {
+      "yubikey": "/path/to/upstream-agent.sock"
+    },
+    "recipient_groups": {
+      "team-prod": ["age1...", "age1..."]
+    },
+    "client_prompts": {
+      "yubikey": "confirm"
+    },
+    "secret_prompts": {
+      "yubikey": "PIN"
+    },
+    "policy": [
+      {"plugin": "yubikey", "state_machine": "recipient-v1", "action": "allow"},
+      {"plugin": "yubikey", "state_machine": "identity-v1", "action": "confirm"}
+    ]
+  }
+
+  upstreams   Forward sessions for these plugins to another agent's socket
+              instead of running a local plugin, e.g. on an SSH bastion
+  recipient_groups
+              X25519 recipients the agent encrypts to for each group's
+              age1agent1... recipient (see groups), so that hosts don't
+              need to carry the recipient list
+  client_prompts
+              Before the plugin acts, have age at the client show a notice
+              ("msg") or ask the user to continue ("confirm") naming this
+              host and the peer the plugin is used for
+  secret_prompts
+              Regular expression matching the plugin's request-secret
+              prompts that the agent answers with the PIN set by pin
+  policy      Rules checked against every protocol message of a session;
+              the first match decides. Rules can match plugin,
+              state_machine (recipient-v1 encrypts, identity-v1 decrypts),
+              message (e.g. file-key), uids of the peer, listener (socket
+              path), hours (e.g. 09:00-18:00) and min_stanzas/max_stanzas
+              (messages of that type so far in the session). action is
+              allow, deny, or confirm, which asks on the agent once per
+              session. Unmatched messages are allowed. Sessions forwarded
+              upstream or served by the agent plugin are checked once;
+              identity stubs are checked like sessions of their plugin.
 
 Examples:
   # Start the server
@@ -49,6 +201,25 @@ Examples:
   # Intercept yubikey plugin
   age-plugin-agent intercept yubikey
 
+  # Decrypt a file with the yubikey plugin intercepted, e.g. in a Makefile
+  age-plugin-agent intercept yubikey -- age -d -i id.txt secret.age
+
+  # Intercept whichever plugins an identity or recipient file needs
+  age-plugin-agent intercept --identities id.txt -- age -d -i id.txt secret.age
+  age-plugin-agent intercept --recipients team.txt -- age -R team.txt -o secret.age secret
+
+  # Intercept permanently, in every new shell
+  age-plugin-agent intercept --install ~/.local/share/age-plugin-agent/bin yubikey,tpm
+  echo 'eval "$(age-plugin-agent shell-init bash)"' >> ~/.bashrc
+
+  # Decrypt with an identity held by the agent, without a key file on this host
+  age-plugin-agent add key.txt
+  age -d -j agent secret.age
+
+  # Decrypt with a yubikey on the agent's host through an identity stub
+  age-plugin-agent identity-stub yubikey yubikey-identity.txt > stub.txt
+  age -d -i stub.txt secret.age
+
   # Manually proxy to a plugin
   age-plugin-agent proxy yubikey
 
@@ -60,7 +231,19 @@ func main() {
 	// Check binary name for automatic proxy mode detection
 	if pluginName, isPluginBinary := getPluginNameFromBinaryName(os.Args[0]); isPluginBinary {
 		// Automatically run in proxy mode for this plugin
-		if err := runProxy(pluginName); err != nil {
+		setupClientLogging()
+		if err := runProxy(pluginName, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// age runs this binary as age-plugin-agent for the agent plugin's
+	// identities, e.g. with age -d -j agent
+	if len(os.Args) >= 2 && strings.HasPrefix(os.Args[1], "--age-plugin=") {
+		setupClientLogging()
+		if err := runProxy(AgentPluginName, os.Args[1:]); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -77,20 +260,83 @@ func main() {
 
 	switch command {
 	case "intercept":
+		flags := flag.NewFlagSet("intercept", flag.ExitOnError)
+		flags.Usage = printUsage
+		installDir := flags.String("install", "", "create persistent symlinks in this directory")
+		var identityFiles, recipientFiles fileList
+		flags.Var(&identityFiles, "identities", "intercept the plugins of the identities in this file (repeatable)")
+		flags.Var(&identityFiles, "from-identity", "same as --identities")
+		flags.Var(&recipientFiles, "recipients", "intercept the plugins of the recipients in this file (repeatable)")
+		flags.Parse(os.Args[2:])
+		args := flags.Args()
+		// Parse consumes a -- directly after the flags, which separates the command
+		if n := len(os.Args) - len(args); os.Args[n-1] == "--" {
+			args = append([]string{"--"}, args...)
+		}
+
+		var plugins []string
+		if len(identityFiles) > 0 || len(recipientFiles) > 0 {
+			var err error
+			plugins, err = pluginsFromKeyFiles(identityFiles, recipientFiles)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			if len(args) < 1 {
+				fmt.Fprintf(os.Stderr, "Error: intercept requires plugin names\n\n")
+				printUsage()
+				os.Exit(1)
+			}
+			plugins = strings.Split(args[0], ",")
+			args = args[1:]
+		}
+
+		if *installDir != "" {
+			if err := runInstall(plugins, *installDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		shell := ""
+		var command []string
+		if len(args) >= 1 {
+			if args[0] == "--" {
+				command = args[1:]
+				if len(command) == 0 {
+					fmt.Fprintf(os.Stderr, "Error: intercept requires a command after --\n\n")
+					printUsage()
+					os.Exit(1)
+				}
+			} else {
+				shell = args[0]
+			}
+		}
+
+		if err := runIntercept(plugins, shell, command); err != nil {
+			var exitErr *exitCodeError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.code)
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "shell-init":
 		if len(os.Args) < 3 {
-			fmt.Fprintf(os.Stderr, "Error: intercept requires plugin names\n\n")
+			fmt.Fprintf(os.Stderr, "Error: shell-init requires a shell name\n\n")
 			printUsage()
 			os.Exit(1)
 		}
-		pluginsArg := os.Args[2]
-		plugins := strings.Split(pluginsArg, ",")
 
-		shell := ""
+		dir := ""
 		if len(os.Args) >= 4 {
-			shell = os.Args[3]
+			dir = os.Args[3]
 		}
 
-		if err := runIntercept(plugins, shell); err != nil {
+		if err := runShellInit(os.Args[2], dir); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -103,18 +349,181 @@ func main() {
 		}
 		pluginName := os.Args[2]
 
-		if err := runProxy(pluginName); err != nil {
+		setupClientLogging()
+		if err := runProxy(pluginName, os.Args[3:]); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "server":
-		socketPath := getSocketPath()
+		config := &Config{SocketPath: getSocketPath()}
+		var err error
+
+		flags := flag.NewFlagSet("server", flag.ExitOnError)
+		flags.Usage = printUsage
+		flags.DurationVar(&config.LockIdle, "lock-idle", 0, "lock the agent after this long without sessions")
+		flags.StringVar(&config.LockCommand, "lock-command", "", "command whose output lines lock the agent")
+		flags.BoolVar(&config.Replace, "replace", false, "shut down an agent already listening on the socket")
+		flags.StringVar(&config.Pinentry, "pinentry", "", "program asking for identity file passphrases and PINs")
+		flags.StringVar(&config.LogLevel, "log-level", "info", "minimum level to log: debug, info, warn or error")
+		flags.StringVar(&config.LogFormat, "log-format", "text", "log format: text or json")
+		flags.StringVar(&config.LogFile, "log-file", "", "append logs to this file instead of stderr")
+		configPath := flags.String("config", "", "path to the JSON configuration file")
+		flags.Parse(os.Args[2:])
+
+		if err := setupLogging(config.LogLevel, config.LogFormat, config.LogFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *configPath != "" {
+			err = loadConfigFile(config, *configPath, true)
+		} else if path := defaultConfigPath(); path != "" {
+			err = loadConfigFile(config, path, false)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if flags.NArg() >= 1 {
+			config.SocketPath = flags.Arg(0)
+		}
+
+		if err := runServer(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "status":
+		if err := runStatus(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "list":
+		if err := runList(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "sessions":
+		if err := runSessions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "cancel":
+		if len(os.Args) < 3 {
+			fmt.Fprintf(os.Stderr, "Error: cancel requires a session ID\n\n")
+			printUsage()
+			os.Exit(1)
+		}
+
+		if err := runCancel(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "lock":
+		if err := runLock(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "unlock":
+		if err := runUnlock(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "add":
+		var opts addOptions
+		flags := flag.NewFlagSet("add", flag.ExitOnError)
+		flags.Usage = printUsage
+		flags.DurationVar(&opts.Lifetime, "t", 0, "remove the identities from the agent after this long")
+		flags.IntVar(&opts.MaxUses, "n", 0, "remove the identities after unwrapping this many file keys")
+		flags.BoolVar(&opts.Confirm, "c", false, "confirm every use of the identities on the agent")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() < 1 {
+			fmt.Fprintf(os.Stderr, "Error: add requires an identity file\n\n")
+			printUsage()
+			os.Exit(1)
+		}
+
+		if err := runAdd(flags.Args(), opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "identities":
+		if err := runIdentities(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "remove":
+		if len(os.Args) < 3 {
+			fmt.Fprintf(os.Stderr, "Error: remove requires a recipient\n\n")
+			printUsage()
+			os.Exit(1)
+		}
+
+		if err := runRemove(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "remove-all":
+		if err := runRemoveAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "groups":
+		if err := runGroups(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "identity-stub":
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fmt.Fprintf(os.Stderr, "Error: identity-stub requires a plugin name\n")
+			os.Exit(1)
+		}
+
+		path := ""
+		if len(os.Args) == 4 {
+			path = os.Args[3]
+		}
+		if err := runIdentityStub(os.Args[2], path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "pin":
+		flags := flag.NewFlagSet("pin", flag.ExitOnError)
+		flags.Usage = printUsage
+		forget := flags.Bool("d", false, "forget the PIN")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: pin requires a plugin name\n")
+			os.Exit(1)
+		}
+		if err := runPIN(flags.Arg(0), *forget); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "doctor":
+		pluginName := ""
 		if len(os.Args) >= 3 {
-			socketPath = os.Args[2]
+			pluginName = os.Args[2]
 		}
 
-		if err := runServer(socketPath); err != nil {
+		if err := runDoctor(pluginName); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
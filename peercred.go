@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCred identifies the process on the other end of a Unix socket
+type peerCred struct {
+	UID int
+	PID int
+}
+
+// describePeer returns a human readable description of the connected peer
+func describePeer(conn net.Conn) string {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("uid=%d pid=%d", cred.UID, cred.PID)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the credentials of the process on the other end of a Unix socket
+func peerCredentials(conn net.Conn) (*peerCred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access socket: %w", err)
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to access socket: %w", err)
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+
+	return &peerCred{UID: int(ucred.Uid), PID: int(ucred.Pid)}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials is not supported on this platform
+func peerCredentials(conn net.Conn) (*peerCred, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// assuanEscape percent-escapes a string for an Assuan command argument
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c == '%' || c < 0x20 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape decodes the percent escapes in Assuan data
+func assuanUnescape(s string) ([]byte, error) {
+	data := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			data = append(data, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("truncated escape in pinentry data")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("malformed escape in pinentry data")
+		}
+		data = append(data, byte(c))
+		i += 2
+	}
+	return data, nil
+}
+
+// errPinentryCancelled reports that the user closed the pinentry dialog
+var errPinentryCancelled = errors.New("cancelled in pinentry")
+
+// Codes of the libgpg-error errors pinentry answers with when the user
+// cancels the dialog or answers no. The error source is in the upper bits.
+const (
+	gpgErrCanceled     = 99
+	gpgErrNotConfirmed = 114
+)
+
+// pinentryError is an ERR answer of pinentry
+type pinentryError struct {
+	code    int
+	message string
+}
+
+// parsePinentryError parses the rest of an ERR line, e.g.
+// "83886179 Operation cancelled <Pinentry>"
+func parsePinentryError(line string) *pinentryError {
+	code, message, _ := strings.Cut(line, " ")
+	n, _ := strconv.Atoi(code)
+	return &pinentryError{code: n, message: message}
+}
+
+func (e *pinentryError) Error() string {
+	if e.cancelled() {
+		return errPinentryCancelled.Error()
+	}
+	return fmt.Sprintf("pinentry failed: %s (error %d)", e.message, e.code)
+}
+
+// Is lets errors.Is match a cancelled dialog to errPinentryCancelled
+func (e *pinentryError) Is(target error) bool {
+	return target == errPinentryCancelled && e.cancelled()
+}
+
+// cancelled reports whether the user closed the dialog
+func (e *pinentryError) cancelled() bool {
+	return e.code&0xffff == gpgErrCanceled
+}
+
+// refused reports whether the user cancelled or answered no to a CONFIRM
+func (e *pinentryError) refused() bool {
+	return e.cancelled() || e.code&0xffff == gpgErrNotConfirmed
+}
+
+// pinentryConn is a conversation with a pinentry program over the Assuan protocol
+type pinentryConn struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+	r   *bufio.Reader
+}
+
+// command sends an Assuan command and returns the data lines of the reply,
+// failing with a *pinentryError if pinentry answers with ERR
+func (p *pinentryConn) command(line string) ([]byte, error) {
+	if line != "" {
+		if _, err := fmt.Fprintf(p.w, "%s\n", line); err != nil {
+			return nil, fmt.Errorf("failed to write to pinentry: %w", err)
+		}
+	}
+
+	var data []byte
+	for {
+		reply, err := p.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from pinentry: %w", err)
+		}
+		reply = strings.TrimRight(reply, "\r\n")
+
+		switch {
+		case reply == "OK" || strings.HasPrefix(reply, "OK "):
+			return data, nil
+		case strings.HasPrefix(reply, "ERR "):
+			wipe(data)
+			return nil, parsePinentryError(strings.TrimPrefix(reply, "ERR "))
+		case strings.HasPrefix(reply, "D "):
+			chunk, err := assuanUnescape(strings.TrimPrefix(reply, "D "))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, chunk...)
+		default:
+			// Status and comment lines carry nothing we need
+		}
+	}
+}
+
+// close ends the conversation and waits for pinentry to exit
+func (p *pinentryConn) close() {
+	p.command("BYE")
+	p.w.Close()
+	p.cmd.Wait()
+}
+
+// startPinentry runs a pinentry program such as pinentry-curses or
+// pinentry-gnome3 and sets up a dialog showing description
+func startPinentry(program, description string) (*pinentryConn, error) {
+	cmd := exec.Command(program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run pinentry: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run pinentry: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run pinentry: %w", err)
+	}
+
+	p := &pinentryConn{cmd: cmd, w: stdin, r: bufio.NewReader(stdout)}
+
+	// Read the greeting, then set up the dialog
+	for _, line := range []string{
+		"",
+		"SETTITLE age-plugin-agent",
+		"SETDESC " + assuanEscape(description),
+	} {
+		if _, err := p.command(line); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// runPinentry asks for a passphrase with a pinentry program
+func runPinentry(program, description, prompt string) ([]byte, error) {
+	p, err := startPinentry(program, description)
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	if _, err := p.command("SETPROMPT " + assuanEscape(prompt)); err != nil {
+		return nil, err
+	}
+	return p.command("GETPIN")
+}
+
+// confirmPinentry asks a yes or no question with a pinentry program. Only the
+// user's answer is a no; a pinentry that fails to ask is an error.
+func confirmPinentry(program, description string) (bool, error) {
+	p, err := startPinentry(program, description)
+	if err != nil {
+		return false, err
+	}
+	defer p.close()
+
+	_, err = p.command("CONFIRM")
+	var answer *pinentryError
+	if errors.As(err, &answer) && answer.refused() {
+		return false, nil
+	}
+	return err == nil, err
+}
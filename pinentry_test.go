@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssuanEscape(t *testing.T) {
+	escaped := assuanEscape("100% sure\nreally")
+	if escaped != "100%25 sure%0Areally" {
+		t.Errorf("assuanEscape() = %q", escaped)
+	}
+
+	unescaped, err := assuanUnescape(escaped)
+	if err != nil || string(unescaped) != "100% sure\nreally" {
+		t.Errorf("assuanUnescape() = %q, %v", unescaped, err)
+	}
+
+	if _, err := assuanUnescape("trailing%2"); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a truncated escape error, got %v", err)
+	}
+}
+
+func TestConfirmPinentry(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    bool
+		wantErr string
+	}{
+		{name: "yes", reply: "OK", want: true},
+		{name: "cancelled", reply: "ERR 83886179 Operation cancelled <Pinentry>"},
+		{name: "no", reply: "ERR 83886194 Not confirmed <Pinentry>"},
+		{
+			name:    "no display",
+			reply:   "ERR 83918950 Inappropriate ioctl for device <Pinentry>",
+			wantErr: "pinentry failed: Inappropriate ioctl for device <Pinentry> (error 83918950)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirmed, err := confirmPinentry(fakePinentryReplying(t, "", tt.reply), "Continue?")
+			if confirmed != tt.want {
+				t.Errorf("confirmPinentry() = %v, want %v", confirmed, tt.want)
+			}
+			if (err != nil || tt.wantErr != "") && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("confirmPinentry() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Only a cancelled dialog is a cancellation for passphrase prompts
+	if err := parsePinentryError("83886179 Operation cancelled"); !errors.Is(err, errPinentryCancelled) {
+		t.Errorf("%v should be a cancellation", err)
+	}
+	if err := parsePinentryError("83886194 Not confirmed"); errors.Is(err, errPinentryCancelled) {
+		t.Errorf("%v should not be a cancellation", err)
+	}
+}
+
+// fakePinentry writes a pinentry program that answers GETPIN with pin and
+// CONFIRM with OK or a cancellation
+func fakePinentry(t *testing.T, pin string, confirm bool) string {
+	t.Helper()
+
+	if confirm {
+		return fakePinentryReplying(t, pin, "OK")
+	}
+	return fakePinentryReplying(t, pin, "ERR 83886179 Operation cancelled")
+}
+
+// fakePinentryReplying writes a pinentry program that answers GETPIN with pin
+// and CONFIRM with confirmReply
+func fakePinentryReplying(t *testing.T, pin string, confirmReply string) string {
+	t.Helper()
+
+	script := `#!/bin/sh
+echo "OK hello"
+while read cmd rest; do
+	case "$cmd" in
+	GETPIN) echo "D ` + pin + `"; echo OK ;;
+	CONFIRM) echo "` + confirmReply + `" ;;
+	BYE) echo OK; exit 0 ;;
+	*) echo OK ;;
+	esac
+done
+`
+	path := filepath.Join(t.TempDir(), "pinentry")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+)
+
+// pinStore holds the secrets the agent answers plugins' request-secret
+// prompts with, such as YubiKey PINs
+type pinStore struct {
+	mu   sync.Mutex
+	pins map[string]*lockedBuffer
+}
+
+// newPinStore creates an empty PIN store
+func newPinStore() *pinStore {
+	return &pinStore{pins: make(map[string]*lockedBuffer)}
+}
+
+// set holds the secret for a plugin, replacing any previous one
+func (p *pinStore) set(pluginName string, secret []byte) error {
+	buffer, err := newLockedBuffer(secret)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if previous, ok := p.pins[pluginName]; ok {
+		previous.destroy()
+	}
+	p.pins[pluginName] = buffer
+	return nil
+}
+
+// forget wipes the secret for a plugin and reports whether there was one
+func (p *pinStore) forget(pluginName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buffer, ok := p.pins[pluginName]
+	if ok {
+		buffer.destroy()
+		delete(p.pins, pluginName)
+	}
+	return ok
+}
+
+// get returns a copy of the secret for a plugin, which the caller wipes
+func (p *pinStore) get(pluginName string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buffer, ok := p.pins[pluginName]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), buffer.data...), true
+}
+
+// pinAttempt is the prompt of a session the agent last answered with a held
+// PIN, until a file key shows that the PIN worked
+type pinAttempt struct {
+	prompt  string
+	pending bool
+}
+
+// answerSecret answers a request-secret command of a plugin from the PIN
+// store if the configuration has the agent answer this prompt. It reports
+// whether it answered; otherwise the command goes on to age. Every command
+// of the plugin passes through here, so that attempt follows the session.
+func (s *Server) answerSecret(t *protocolTap, command *Stanza, pluginName string, sess *session, attempt *pinAttempt) (bool, error) {
+	if command.Type == "file-key" {
+		attempt.pending = false
+	}
+	if command.Type != "request-secret" {
+		return false, nil
+	}
+	pattern, ok := s.config.SecretPrompts[pluginName]
+	if !ok {
+		return false, nil
+	}
+	prompt := string(command.Body)
+	if matched, _ := regexp.MatchString(pattern, prompt); !matched {
+		return false, nil
+	}
+
+	// Plugins ask again when a PIN is rejected. Retrying with the same PIN
+	// would only use up the device's retry counter. Other prompts, such as
+	// those of a second device, are answered as usual.
+	if attempt.pending && attempt.prompt == prompt {
+		attempt.pending = false
+		s.pins.forget(pluginName)
+		sess.log.Warn("plugin asked for its PIN again, forgetting the held PIN")
+		if _, err := t.ask(&Stanza{Type: "msg", Body: []byte(fmt.Sprintf(
+			"age-plugin-agent: the PIN held for the %s plugin was rejected and has been forgotten", pluginName))}); err != nil {
+			return true, err
+		}
+		return true, t.toPlugin(&Stanza{Type: "fail"})
+	}
+
+	pin, ok := s.pins.get(pluginName)
+	if !ok {
+		// Never fall back to asking at the client, which this is meant to avoid
+		sess.log.Warn("plugin asked for a PIN the agent does not hold")
+		if _, err := t.ask(&Stanza{Type: "msg", Body: []byte(fmt.Sprintf(
+			"age-plugin-agent holds no PIN for the %s plugin; run age-plugin-agent pin %s", pluginName, pluginName))}); err != nil {
+			return true, err
+		}
+		return true, t.toPlugin(&Stanza{Type: "fail"})
+	}
+	defer wipe(pin)
+
+	sess.log.Info("answered plugin PIN request on the agent")
+	*attempt = pinAttempt{prompt: prompt, pending: true}
+	return true, t.toPlugin(&Stanza{Type: "ok", Body: pin})
+}
+
+// handlePIN answers the pin control command: the argument is the plugin
+// name, and the PIN is asked for on the agent side, like the passphrases of
+// encrypted identity files
+func (s *Server) handlePIN(conn net.Conn, args []string) error {
+	if len(args) != 1 {
+		conn.Write([]byte("ERROR pin requires a plugin name\n"))
+		return fmt.Errorf("pin requires a plugin name")
+	}
+
+	pluginName := args[0]
+	if _, ok := s.config.SecretPrompts[pluginName]; !ok {
+		conn.Write([]byte(fmt.Sprintf("ERROR the agent config has no secret_prompts entry for plugin %s\n", pluginName)))
+		return fmt.Errorf("no secret_prompts entry for plugin %s", pluginName)
+	}
+
+	description := fmt.Sprintf("Enter the PIN of the %s plugin set by %s.", pluginName, describePeer(conn))
+	pin, err := s.askPassphrase(description, "PIN")
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+		return err
+	}
+	defer wipe(pin)
+
+	if err := s.pins.set(pluginName, pin); err != nil {
+		conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+		return err
+	}
+	logger.Info("PIN set by control command", "plugin", pluginName)
+	return writeControlResponse(conn, nil)
+}
+
+// runPIN implements the pin subcommand
+func runPIN(pluginName string, forget bool) error {
+	if forget {
+		var forgotten bool
+		if err := dialControl("forget-pin", []string{pluginName}, &forgotten); err != nil {
+			return err
+		}
+		if !forgotten {
+			fmt.Printf("The agent holds no PIN for %s\n", pluginName)
+			return nil
+		}
+		fmt.Printf("PIN for %s forgotten\n", pluginName)
+		return nil
+	}
+
+	fmt.Printf("Enter the PIN for %s on the agent\n", pluginName)
+	if err := dialControl("pin", []string{pluginName}, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("The agent now answers PIN requests of %s\n", pluginName)
+	return nil
+}
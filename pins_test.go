@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// requestPIN is a plugin that asks for its PIN up to twice, until it gets
+// "123456", and then reports a file key
+func requestPIN(r *bufio.Reader, w io.Writer) []string {
+	var saw []string
+	for i := 0; i < 2; i++ {
+		writeStanza(w, &Stanza{Type: "request-secret", Body: []byte("Enter PIN for YubiKey")})
+		response, err := readStanza(r)
+		if err != nil {
+			return append(saw, "eof")
+		}
+		saw = append(saw, response.Type+":"+string(response.Body))
+		if string(response.Body) == "123456" {
+			return append(saw, unwrapOneFile(r, w)...)
+		}
+	}
+	writeStanza(w, &Stanza{Type: "done"})
+	return saw
+}
+
+// requestTwoPINs is a plugin with the identities of two devices, which each
+// ask for their PIN, and then reports a file key
+func requestTwoPINs(r *bufio.Reader, w io.Writer) []string {
+	var saw []string
+	for _, serial := range []string{"1", "2"} {
+		writeStanza(w, &Stanza{Type: "request-secret", Body: []byte("Enter PIN for YubiKey with serial " + serial)})
+		response, err := readStanza(r)
+		if err != nil {
+			return append(saw, "eof")
+		}
+		saw = append(saw, response.Type+":"+string(response.Body))
+	}
+	return append(saw, unwrapOneFile(r, w)...)
+}
+
+func TestAnswerSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		prompts    map[string]string
+		pin        string
+		phase2     pluginPhase2
+		wantAge    []string
+		wantPlugin []string
+		wantHeld   bool
+	}{
+		{
+			name:       "answered on the agent",
+			prompts:    map[string]string{"yubikey": "PIN"},
+			pin:        "123456",
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok:123456", "ok"},
+			wantHeld:   true,
+		},
+		{
+			name:       "prompt not configured",
+			prompts:    map[string]string{"tpm": "PIN"},
+			pin:        "123456",
+			wantAge:    []string{"request-secret", "request-secret", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok:", "ok:"},
+			wantHeld:   true,
+		},
+		{
+			name:       "prompt does not match",
+			prompts:    map[string]string{"yubikey": "^Passphrase"},
+			pin:        "123456",
+			wantAge:    []string{"request-secret", "request-secret", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok:", "ok:"},
+			wantHeld:   true,
+		},
+		{
+			name:       "no PIN held",
+			prompts:    map[string]string{"yubikey": ""},
+			wantAge:    []string{"msg", "msg", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "fail:", "fail:"},
+		},
+		{
+			name:       "wrong PIN is forgotten",
+			prompts:    map[string]string{"yubikey": "PIN"},
+			pin:        "000000",
+			wantAge:    []string{"msg", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok:000000", "fail:"},
+		},
+		{
+			name:       "two devices",
+			prompts:    map[string]string{"yubikey": ""},
+			pin:        "123456",
+			phase2:     requestTwoPINs,
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok:123456", "ok:123456", "ok"},
+			wantHeld:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(&Config{SecretPrompts: tt.prompts})
+			if tt.pin != "" {
+				if err := server.pins.set("yubikey", []byte(tt.pin)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			phase2 := tt.phase2
+			if phase2 == nil {
+				phase2 = requestPIN
+			}
+			result := runTap(t, server, "yubikey", "", phase2)
+			if result.err != nil {
+				t.Fatalf("relayProtocol() error = %v", result.err)
+			}
+			if !reflect.DeepEqual(result.ageSaw, tt.wantAge) {
+				t.Errorf("age saw %v, want %v", result.ageSaw, tt.wantAge)
+			}
+			if !reflect.DeepEqual(result.pluginSaw, tt.wantPlugin) {
+				t.Errorf("plugin saw %v, want %v", result.pluginSaw, tt.wantPlugin)
+			}
+			if _, held := server.pins.get("yubikey"); held != tt.wantHeld {
+				t.Errorf("PIN held = %v, want %v", held, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestPinStore(t *testing.T) {
+	store := newPinStore()
+	if err := store.set("yubikey", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.set("yubikey", []byte("5678")); err != nil {
+		t.Fatal(err)
+	}
+
+	pin, ok := store.get("yubikey")
+	if !ok || string(pin) != "5678" {
+		t.Fatalf("get() = %q, %v, want the latest PIN", pin, ok)
+	}
+	if !store.forget("yubikey") {
+		t.Error("forget() = false for a held PIN")
+	}
+	if store.forget("yubikey") {
+		t.Error("forget() = true for a forgotten PIN")
+	}
+	if _, ok := store.get("yubikey"); ok {
+		t.Error("get() found a forgotten PIN")
+	}
+}
+
+func TestHandlePIN(t *testing.T) {
+	server := newServer(&Config{
+		Pinentry:      fakePinentry(t, "123456", true),
+		SecretPrompts: map[string]string{"yubikey": "PIN"},
+	})
+
+	tests := []struct {
+		plugin  string
+		wantErr bool
+	}{
+		{plugin: "yubikey"},
+		{plugin: "tpm", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.plugin, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+			go server.handleConnection(serverConn)
+
+			err := performControl(clientConn, "pin", []string{tt.plugin}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pin error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The PIN comes from the agent side, not the client
+	pin, ok := server.pins.get("yubikey")
+	if !ok || string(pin) != "123456" {
+		t.Errorf("held PIN = %q, %v, want the PIN from pinentry", pin, ok)
+	}
+	if _, ok := server.pins.get("tpm"); ok {
+		t.Error("PIN held for a plugin without secret_prompts")
+	}
+}
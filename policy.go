@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Policy actions
+const (
+	policyAllow   = "allow"
+	policyDeny    = "deny"
+	policyConfirm = "confirm"
+)
+
+// errPolicyDenied reports that the policy denied a message, or that its
+// confirmation was refused
+var errPolicyDenied = errors.New("denied by policy")
+
+// PolicyRule matches messages of plugin sessions. Empty fields match
+// anything; the first rule matching a message decides its action.
+type PolicyRule struct {
+	// Plugin is the plugin name
+	Plugin string `json:"plugin,omitempty"`
+	// StateMachine is identity-v1 to decrypt or recipient-v1 to encrypt
+	StateMachine string `json:"state_machine,omitempty"`
+	// Message is the type of the protocol message, e.g. file-key
+	Message string `json:"message,omitempty"`
+	// UIDs are the user IDs of the peer
+	UIDs []int `json:"uids,omitempty"`
+	// Listener is the path of the socket the session came in on
+	Listener string `json:"listener,omitempty"`
+	// Hours is a local time of day window, e.g. 09:00-18:00 or 22:00-06:00
+	Hours string `json:"hours,omitempty"`
+	// MinStanzas and MaxStanzas bound how many messages of this type the
+	// session has sent so far, this one included
+	MinStanzas int `json:"min_stanzas,omitempty"`
+	MaxStanzas int `json:"max_stanzas,omitempty"`
+	// Action is allow, deny or confirm
+	Action string `json:"action"`
+}
+
+// parseHours parses a time of day window into minutes after midnight
+func parseHours(hours string) (int, int, error) {
+	var startH, startM, endH, endM int
+	if _, err := fmt.Sscanf(hours, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); err != nil {
+		return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", hours)
+	}
+	for _, v := range []int{startH, endH} {
+		if v < 0 || v > 24 {
+			return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", hours)
+		}
+	}
+	for _, v := range []int{startM, endM} {
+		if v < 0 || v > 59 {
+			return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", hours)
+		}
+	}
+	return startH*60 + startM, endH*60 + endM, nil
+}
+
+// validate checks a rule for values the server can't use
+func (r *PolicyRule) validate() error {
+	switch r.Action {
+	case policyAllow, policyDeny, policyConfirm:
+	default:
+		return fmt.Errorf("action must be %q, %q or %q", policyAllow, policyDeny, policyConfirm)
+	}
+	if r.Plugin != "" {
+		if err := validatePluginName(r.Plugin); err != nil {
+			return fmt.Errorf("invalid plugin name %q: %w", r.Plugin, err)
+		}
+	}
+	if r.StateMachine != "" && !tappedStateMachines[r.StateMachine] {
+		return fmt.Errorf("unknown state machine %q", r.StateMachine)
+	}
+	if r.Hours != "" {
+		if _, _, err := parseHours(r.Hours); err != nil {
+			return err
+		}
+	}
+	if r.MinStanzas < 0 || r.MaxStanzas < 0 || (r.MaxStanzas > 0 && r.MaxStanzas < r.MinStanzas) {
+		return fmt.Errorf("invalid stanza bounds %d-%d", r.MinStanzas, r.MaxStanzas)
+	}
+	return nil
+}
+
+// policySession is what the policy knows about a session, and what it has
+// decided for it so far
+type policySession struct {
+	plugin       string
+	stateMachine string
+	listener     string
+	// uid is the peer's user ID, or -1 if unknown
+	uid int
+	// counts are the messages seen per type
+	counts map[string]int
+	// confirmed are the indexes of confirm rules the user allowed
+	confirmed map[int]bool
+}
+
+// newPolicySession describes a new session for the policy
+func newPolicySession(conn net.Conn, req *handshakeRequest) *policySession {
+	p := &policySession{
+		plugin:       req.PluginName,
+		stateMachine: req.Options.StateMachine,
+		uid:          -1,
+		counts:       make(map[string]int),
+		confirmed:    make(map[int]bool),
+	}
+	if cred, err := peerCredentials(conn); err == nil {
+		p.uid = cred.UID
+	}
+	if addr := conn.LocalAddr(); addr != nil {
+		p.listener = addr.String()
+	}
+	return p
+}
+
+// matches reports whether a rule matches a message of the session
+func (r *PolicyRule) matches(p *policySession, message string, now time.Time) bool {
+	if r.Plugin != "" && r.Plugin != p.plugin {
+		return false
+	}
+	if r.StateMachine != "" && r.StateMachine != p.stateMachine {
+		return false
+	}
+	if r.Message != "" && r.Message != message {
+		return false
+	}
+	if r.Listener != "" && r.Listener != p.listener {
+		return false
+	}
+	if len(r.UIDs) > 0 {
+		found := false
+		for _, uid := range r.UIDs {
+			found = found || uid == p.uid
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Hours != "" {
+		start, end, _ := parseHours(r.Hours)
+		minute := now.Hour()*60 + now.Minute()
+		if start <= end && (minute < start || minute >= end) {
+			return false
+		}
+		// The window wraps around midnight
+		if start > end && minute < start && minute >= end {
+			return false
+		}
+	}
+	count := p.counts[message]
+	if r.MinStanzas > 0 && count < r.MinStanzas {
+		return false
+	}
+	if r.MaxStanzas > 0 && count > r.MaxStanzas {
+		return false
+	}
+	return true
+}
+
+// evaluate counts a message of the session and returns the index of the
+// first rule matching it, or -1
+func (p *policySession) evaluate(rules []PolicyRule, message string, now time.Time) int {
+	p.counts[message]++
+	for i := range rules {
+		if rules[i].matches(p, message, now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// denySessionTimeout bounds how long a denied session may take to finish
+// its phase 1 before the agent hangs up
+const denySessionTimeout = 30 * time.Second
+
+// denySession ends a session the policy denied at its start. age only
+// reads the error once it sent all of its phase 1 commands.
+func denySession(conn net.Conn, err error) {
+	conn.SetDeadline(time.Now().Add(denySessionTimeout))
+	t := &protocolTap{ageR: bufio.NewReader(conn), ageW: conn}
+	for {
+		stanza, err := t.fromAge()
+		if err != nil {
+			return
+		}
+		if stanza.Type == "done" {
+			break
+		}
+	}
+	t.deny(err)
+}
+
+// stubSession describes the identity-v1 session of the plugin behind an
+// identity stub, which the agent plugin runs for the same peer
+func (p *policySession) stubSession(target string) *policySession {
+	if p == nil {
+		return nil
+	}
+	return &policySession{
+		plugin:       target,
+		stateMachine: "identity-v1",
+		listener:     p.listener,
+		uid:          p.uid,
+		counts:       make(map[string]int),
+		confirmed:    make(map[int]bool),
+	}
+}
+
+// checkPolicy applies the policy to one message of a session, as described
+// by p. An empty message stands for a session the agent does not parse,
+// checked once.
+func (s *Server) checkPolicy(sess *session, p *policySession, message string) error {
+	if p == nil || len(s.config.Policy) == 0 {
+		return nil
+	}
+
+	index := p.evaluate(s.config.Policy, message, time.Now())
+	if index < 0 {
+		return nil
+	}
+	rule := &s.config.Policy[index]
+
+	log := sess.log
+	if p.plugin != sess.plugin {
+		log = log.With("target", p.plugin)
+	}
+
+	switch rule.Action {
+	case policyDeny:
+		log.Warn("message denied by policy", "rule", index+1, "message", message)
+		return fmt.Errorf("%w (rule %d)", errPolicyDenied, index+1)
+	case policyConfirm:
+		if p.confirmed[index] {
+			return nil
+		}
+
+		operation := "use"
+		switch p.stateMachine {
+		case "identity-v1":
+			operation = "decrypt with"
+		case "recipient-v1":
+			operation = "encrypt with"
+		}
+		question := fmt.Sprintf("Allow %s to %s the %s plugin?", sess.peer, operation, p.plugin)
+
+		confirmed, err := s.askConfirmation(question)
+		if err != nil {
+			log.Warn("policy confirmation failed", "rule", index+1, "message", message, "err", err)
+			return fmt.Errorf("%w (rule %d): %v", errPolicyDenied, index+1, err)
+		}
+		if !confirmed {
+			log.Warn("policy confirmation refused", "rule", index+1, "message", message)
+			return fmt.Errorf("%w (rule %d): refused on the agent", errPolicyDenied, index+1)
+		}
+		log.Info("policy confirmation accepted", "rule", index+1, "message", message)
+		p.confirmed[index] = true
+	}
+	return nil
+}
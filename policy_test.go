@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    PolicyRule
+		wantErr bool
+	}{
+		{"allow everything", PolicyRule{Action: policyAllow}, false},
+		{"full rule", PolicyRule{Plugin: "yubikey", StateMachine: "identity-v1", Message: "file-key", UIDs: []int{1000},
+			Listener: "/run/agent.sock", Hours: "09:00-18:00", MinStanzas: 1, MaxStanzas: 3, Action: policyConfirm}, false},
+		{"wrapping hours", PolicyRule{Hours: "22:00-06:30", Action: policyDeny}, false},
+		{"missing action", PolicyRule{Plugin: "yubikey"}, true},
+		{"unknown action", PolicyRule{Action: "ask"}, true},
+		{"invalid plugin name", PolicyRule{Plugin: "../x", Action: policyDeny}, true},
+		{"unknown state machine", PolicyRule{StateMachine: "identity-v2", Action: policyDeny}, true},
+		{"malformed hours", PolicyRule{Hours: "9-17", Action: policyDeny}, true},
+		{"out of range hours", PolicyRule{Hours: "09:00-25:00", Action: policyDeny}, true},
+		{"inverted stanza bounds", PolicyRule{MinStanzas: 3, MaxStanzas: 2, Action: policyDeny}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	session := func() *policySession {
+		return &policySession{
+			plugin:       "yubikey",
+			stateMachine: "identity-v1",
+			listener:     "/run/agent.sock",
+			uid:          1000,
+			counts:       map[string]int{"file-key": 2},
+		}
+	}
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2026, 1, 1, 23, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		rule    PolicyRule
+		message string
+		now     time.Time
+		want    bool
+	}{
+		{"empty rule", PolicyRule{}, "file-key", noon, true},
+		{"plugin", PolicyRule{Plugin: "yubikey"}, "file-key", noon, true},
+		{"other plugin", PolicyRule{Plugin: "tpm"}, "file-key", noon, false},
+		{"state machine", PolicyRule{StateMachine: "identity-v1"}, "file-key", noon, true},
+		{"other state machine", PolicyRule{StateMachine: "recipient-v1"}, "file-key", noon, false},
+		{"message", PolicyRule{Message: "file-key"}, "file-key", noon, true},
+		{"other message", PolicyRule{Message: "request-secret"}, "file-key", noon, false},
+		{"uid", PolicyRule{UIDs: []int{0, 1000}}, "file-key", noon, true},
+		{"other uid", PolicyRule{UIDs: []int{0}}, "file-key", noon, false},
+		{"listener", PolicyRule{Listener: "/run/agent.sock"}, "file-key", noon, true},
+		{"other listener", PolicyRule{Listener: "/run/other.sock"}, "file-key", noon, false},
+		{"within hours", PolicyRule{Hours: "09:00-18:00"}, "file-key", noon, true},
+		{"outside hours", PolicyRule{Hours: "09:00-18:00"}, "file-key", night, false},
+		{"within wrapping hours", PolicyRule{Hours: "22:00-06:00"}, "file-key", night, true},
+		{"outside wrapping hours", PolicyRule{Hours: "22:00-06:00"}, "file-key", noon, false},
+		{"enough stanzas", PolicyRule{MinStanzas: 2}, "file-key", noon, true},
+		{"too few stanzas", PolicyRule{MinStanzas: 3}, "file-key", noon, false},
+		{"too many stanzas", PolicyRule{MaxStanzas: 1}, "file-key", noon, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(session(), tt.message, tt.now); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyEvaluateCounts(t *testing.T) {
+	rules := []PolicyRule{
+		{Message: "file-key", MinStanzas: 3, Action: policyDeny},
+		{Action: policyAllow},
+	}
+	p := &policySession{counts: make(map[string]int)}
+
+	var got []int
+	for i := 0; i < 4; i++ {
+		p.evaluate(rules, "msg", time.Now())
+		got = append(got, p.evaluate(rules, "file-key", time.Now()))
+	}
+	if want := []int{1, 1, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("evaluate() = %v, want %v", got, want)
+	}
+}
+
+func TestRelayProtocolPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []PolicyRule
+		confirm    bool
+		wantAge    []string
+		wantPlugin []string
+		wantErr    error
+	}{
+		{
+			name:       "encryption rules don't apply",
+			rules:      []PolicyRule{{StateMachine: "recipient-v1", Action: policyDeny}},
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:       "denied in phase 1",
+			rules:      []PolicyRule{{Plugin: "yubikey", Message: "recipient-stanza", Action: policyDeny}},
+			wantAge:    []string{"error"},
+			wantPlugin: []string{"add-identity", "eof"},
+			wantErr:    errPolicyDenied,
+		},
+		{
+			name:       "denied in phase 2",
+			rules:      []PolicyRule{{Message: "file-key", Action: policyDeny}},
+			wantAge:    []string{"error"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done"},
+			wantErr:    errPolicyDenied,
+		},
+		{
+			name:       "allow rule comes first",
+			rules:      []PolicyRule{{Plugin: "yubikey", Action: policyAllow}, {Action: policyDeny}},
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:       "confirmed once per session",
+			rules:      []PolicyRule{{StateMachine: "identity-v1", Action: policyConfirm}},
+			confirm:    true,
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:       "confirmation refused",
+			rules:      []PolicyRule{{StateMachine: "identity-v1", Action: policyConfirm}},
+			wantAge:    []string{"error"},
+			wantPlugin: []string{"eof"},
+			wantErr:    errPolicyDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(&Config{Policy: tt.rules, Pinentry: fakePinentry(t, "", tt.confirm)})
+
+			result := runTap(t, server, "yubikey", "", unwrapOneFile)
+			if !errors.Is(result.err, tt.wantErr) {
+				t.Fatalf("relayProtocol() error = %v, want %v", result.err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(result.ageSaw, tt.wantAge) {
+				t.Errorf("age saw %v, want %v", result.ageSaw, tt.wantAge)
+			}
+			if !reflect.DeepEqual(result.pluginSaw, tt.wantPlugin) {
+				t.Errorf("plugin saw %v, want %v", result.pluginSaw, tt.wantPlugin)
+			}
+		})
+	}
+}
@@ -1,14 +1,164 @@
 package main
 
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	// MaxPluginNameLength is the maximum allowed length for plugin names
 	MaxPluginNameLength = 64
 	// PluginNamePattern is the regex pattern for valid plugin names
 	PluginNamePattern = `^[a-zA-Z0-9-]+$`
+	// ProtocolVersion is the version of the handshake protocol spoken by this binary
+	ProtocolVersion = 1
+	// ControlPrefix marks a handshake line as a control command instead of a plugin name.
+	// It can never collide with a plugin name because it fails PluginNamePattern.
+	ControlPrefix = "@"
+	// AgentPluginName is the plugin the server serves itself from the
+	// identities added to it, instead of running a plugin binary
+	AgentPluginName = "agent"
+	// MaxHops is the number of agents a session may pass through before the
+	// server assumes agents are forwarding to each other in a loop
+	MaxHops = 8
+	// HopsEnvVar tells a proxy started by a server plugin process how many
+	// agents its session has already passed through
+	HopsEnvVar = "AGE_PLUGIN_AGENT_HOPS"
+	// FallbackEnvVar selects what a proxy does when the agent is unreachable
+	// or doesn't have the plugin: "local" runs the plugin from the local PATH
+	FallbackEnvVar = "AGE_PLUGIN_AGENT_FALLBACK"
+	// RetryTimeoutEnvVar bounds how long a proxy retries connecting to an
+	// agent that is temporarily unavailable, as a Go duration such as "10s"
+	RetryTimeoutEnvVar = "AGE_PLUGIN_AGENT_RETRY_TIMEOUT"
+	// DebugEnvVar names a file a proxy appends debug logs to, since its
+	// stdout and stderr belong to age
+	DebugEnvVar = "AGE_PLUGIN_AGENT_DEBUG"
+)
+
+var (
+	stateMachineRegex = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	hostNameRegex     = regexp.MustCompile(`^[a-zA-Z0-9.-]+$`)
+	groupNameRegex    = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
 )
 
+// handshakeOptions are the optional key=value fields that follow the plugin
+// name in a handshake line. Unknown keys are ignored so that newer clients
+// can talk to older servers.
+type handshakeOptions struct {
+	// Hops is the number of agents the session has already passed through
+	Hops int
+	// StateMachine is the age plugin state machine age asked for, such as
+	// recipient-v1, passed to the plugin as --age-plugin=<state machine>
+	StateMachine string
+	// Via lists the hosts the session came through, starting with the host
+	// age runs on, for the audit trail of each agent along the way
+	Via []string
+}
+
+// encode formats the options for the handshake line, omitting defaults so
+// that plain sessions keep the original one-word handshake
+func (o handshakeOptions) encode() string {
+	var fields []string
+	if o.StateMachine != "" {
+		fields = append(fields, "sm="+o.StateMachine)
+	}
+	if o.Hops > 0 {
+		fields = append(fields, "hops="+strconv.Itoa(o.Hops))
+	}
+	if len(o.Via) > 0 {
+		fields = append(fields, "via="+strings.Join(o.Via, ","))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return " " + strings.Join(fields, " ")
+}
+
+// parseHandshakeOptions parses the key=value fields of a handshake line
+func parseHandshakeOptions(fields []string) (handshakeOptions, error) {
+	var opts handshakeOptions
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return opts, fmt.Errorf("malformed handshake option: %s", field)
+		}
+
+		switch key {
+		case "hops":
+			hops, err := strconv.Atoi(value)
+			if err != nil || hops < 0 {
+				return opts, fmt.Errorf("invalid hop count: %s", value)
+			}
+			opts.Hops = hops
+		case "sm":
+			if !stateMachineRegex.MatchString(value) {
+				return opts, fmt.Errorf("invalid state machine: %s", value)
+			}
+			opts.StateMachine = value
+		case "via":
+			hosts := strings.Split(value, ",")
+			for _, host := range hosts {
+				if !hostNameRegex.MatchString(host) {
+					return opts, fmt.Errorf("invalid host name: %s", host)
+				}
+			}
+			opts.Via = hosts
+		}
+	}
+	return opts, nil
+}
+
 // HandshakeResponse represents the server's response to a handshake
 type HandshakeResponse struct {
 	Success bool
 	Error   string
 }
+
+// SessionInfo describes a plugin session running on the server
+type SessionInfo struct {
+	ID       uint64    `json:"id"`
+	Plugin   string    `json:"plugin"`
+	Peer     string    `json:"peer"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// IdentityInfo describes an identity held by the agent, without its secret key
+type IdentityInfo struct {
+	Recipient string     `json:"recipient"`
+	Added     time.Time  `json:"added"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	MaxUses   int        `json:"max_uses,omitempty"`
+	Uses      int        `json:"uses"`
+	Confirm   bool       `json:"confirm,omitempty"`
+}
+
+// RecipientGroupInfo describes a recipient group defined on the agent
+type RecipientGroupInfo struct {
+	Name      string   `json:"name"`
+	Recipient string   `json:"recipient"`
+	Members   []string `json:"members"`
+}
+
+// PluginInfo describes a plugin the server is able to run
+type PluginInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// StatusResponse is the server's reply to the status control command
+type StatusResponse struct {
+	Version         string            `json:"version"`
+	ProtocolVersion int               `json:"protocol_version"`
+	Started         time.Time         `json:"started"`
+	Listeners       []string          `json:"listeners"`
+	Locked          bool              `json:"locked"`
+	Upstreams       map[string]string `json:"upstreams,omitempty"`
+	Identities      int               `json:"identities"`
+	Sessions        []SessionInfo     `json:"sessions"`
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHandshakeOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		wantErr  bool
+		wantOpts handshakeOptions
+	}{
+		{
+			name:     "no options",
+			fields:   nil,
+			wantOpts: handshakeOptions{},
+		},
+		{
+			name:     "hop count",
+			fields:   []string{"hops=3"},
+			wantOpts: handshakeOptions{Hops: 3},
+		},
+		{
+			name:     "unknown options are ignored",
+			fields:   []string{"future=yes", "hops=1"},
+			wantOpts: handshakeOptions{Hops: 1},
+		},
+		{
+			name:     "state machine",
+			fields:   []string{"sm=identity-v1", "hops=2"},
+			wantOpts: handshakeOptions{StateMachine: "identity-v1", Hops: 2},
+		},
+		{
+			name:    "invalid state machine",
+			fields:  []string{"sm=--evil"},
+			wantErr: true,
+		},
+		{
+			name:     "route",
+			fields:   []string{"via=laptop,bastion.example.com"},
+			wantOpts: handshakeOptions{Via: []string{"laptop", "bastion.example.com"}},
+		},
+		{
+			name:    "invalid host in route",
+			fields:  []string{"via=laptop,bad/host"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed option",
+			fields:  []string{"hops"},
+			wantErr: true,
+		},
+		{
+			name:    "negative hop count",
+			fields:  []string{"hops=-1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseHandshakeOptions(tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHandshakeOptions(%q) error = %v, wantErr %v", tt.fields, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(opts, tt.wantOpts) {
+				t.Errorf("parseHandshakeOptions(%q) = %+v, want %+v", tt.fields, opts, tt.wantOpts)
+			}
+		})
+	}
+
+	// Defaults encode to nothing so that old servers understand the handshake
+	if encoded := (handshakeOptions{}).encode(); encoded != "" {
+		t.Errorf("encode() of default options = %q, want empty", encoded)
+	}
+	if encoded := (handshakeOptions{Hops: 2}).encode(); encoded != " hops=2" {
+		t.Errorf("encode() = %q, want %q", encoded, " hops=2")
+	}
+}
@@ -2,16 +2,26 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	// retryInitialBackoff is the delay before the first connection retry
+	retryInitialBackoff = 100 * time.Millisecond
+	// retryMaxBackoff caps the delay between connection retries
+	retryMaxBackoff = 2 * time.Second
+)
+
 // performClientHandshake handles the client side of the handshake protocol
-func performClientHandshake(conn net.Conn, pluginName string) error {
+func performClientHandshake(conn net.Conn, pluginName string, opts handshakeOptions) error {
 	// Validate plugin name
 	if err := validatePluginName(pluginName); err != nil {
 		return fmt.Errorf("invalid plugin name: %w", err)
@@ -23,7 +33,7 @@ func performClientHandshake(conn net.Conn, pluginName string) error {
 	}
 
 	// Send plugin name
-	if _, err := fmt.Fprintf(conn, "%s\n", pluginName); err != nil {
+	if _, err := fmt.Fprintf(conn, "%s%s\n", pluginName, opts.encode()); err != nil {
 		return fmt.Errorf("failed to send plugin name: %w", err)
 	}
 
@@ -51,46 +61,197 @@ func performClientHandshake(conn net.Conn, pluginName string) error {
 	return fmt.Errorf("unexpected handshake response: %s", response)
 }
 
-// runProxy implements the proxy subcommand
-func runProxy(pluginName string) error {
-	// Get socket path
-	socketPath := getSocketPath()
+// stateMachineFromArgs extracts the state machine age requested with
+// --age-plugin=<name> from the plugin's arguments
+func stateMachineFromArgs(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--age-plugin=") {
+			return strings.TrimPrefix(arg, "--age-plugin=")
+		}
+	}
+	return ""
+}
+
+// localFallbackEnabled reports whether the proxy should run the plugin
+// locally when the agent can't serve it
+func localFallbackEnabled() bool {
+	return os.Getenv(FallbackEnvVar) == "local"
+}
 
-	// Connect to Unix domain socket
-	conn, err := net.Dial("unix", socketPath)
+// execLocalPlugin replaces the current process with the real plugin binary
+// found on PATH, skipping intercept shims. It only returns on error.
+func execLocalPlugin(pluginName string, args []string) error {
+	pluginPath, err := findPluginBinary(pluginName)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server at %s: %w", socketPath, err)
+		return fmt.Errorf("local fallback failed: %w", err)
 	}
-	defer conn.Close()
 
-	// Perform handshake
-	if err := performClientHandshake(conn, pluginName); err != nil {
-		return err
+	argv := append([]string{pluginPath}, args...)
+	if err := syscall.Exec(pluginPath, argv, os.Environ()); err != nil {
+		return fmt.Errorf("local fallback failed to run %s: %w", pluginPath, err)
 	}
+	return nil
+}
 
-	// Start bidirectional proxying
-	done := make(chan error, 2)
+// agentUnavailableError reports that no agent could serve a plugin because
+// none was reachable or none of them had the plugin
+type agentUnavailableError struct {
+	reasons []error
+}
 
-	// Goroutine: stdin -> socket
-	go func() {
-		_, err := io.Copy(conn, os.Stdin)
-		done <- err
-	}()
+func (e *agentUnavailableError) Error() string {
+	reasons := make([]string, len(e.reasons))
+	for i, reason := range e.reasons {
+		reasons[i] = reason.Error()
+	}
+	return fmt.Sprintf("no agent accepted the plugin: %s", strings.Join(reasons, "; "))
+}
 
-	// Main thread: socket -> stdout
-	go func() {
-		_, err := io.Copy(os.Stdout, conn)
-		done <- err
-	}()
+// connectAgent tries each candidate socket in order and returns a connection
+// to the first agent that accepts a session for the plugin
+func connectAgent(pluginName string, opts handshakeOptions) (net.Conn, error) {
+	unavailable := &agentUnavailableError{}
+	var firstErr error
+
+	for _, socketPath := range getSocketCandidates() {
+		if err := checkSocketPath(socketPath); err != nil {
+			logger.Warn("skipping unsafe socket", "socket", socketPath, "err", err)
+			unavailable.reasons = append(unavailable.reasons, fmt.Errorf("skipping %s: %w", socketPath, err))
+			continue
+		}
+
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			logger.Debug("failed to connect to agent", "socket", socketPath, "err", err)
+			unavailable.reasons = append(unavailable.reasons, fmt.Errorf("failed to connect to server at %s: %w", socketPath, err))
+			continue
+		}
+
+		err = performClientHandshake(conn, pluginName, opts)
+		if err == nil {
+			logger.Debug("agent accepted session", "socket", socketPath)
+			return conn, nil
+		}
+		conn.Close()
+		logger.Debug("agent rejected session", "socket", socketPath, "err", err)
+
+		if strings.Contains(err.Error(), "plugin not found") {
+			unavailable.reasons = append(unavailable.reasons, fmt.Errorf("%s: %w", socketPath, err))
+		} else if firstErr == nil {
+			// Remember the most informative error, e.g. a locked agent
+			firstErr = fmt.Errorf("%s: %w", socketPath, err)
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, unavailable
+}
 
-	// Wait for either direction to complete
-	err = <-done
+// isTransientConnectError reports whether a failure to connect may go away
+// by itself: the socket doesn't exist yet or nobody listens on it, as while
+// an SSH connection carrying the forwarded socket reconnects
+func isTransientConnectError(err error) bool {
+	var unavailable *agentUnavailableError
+	if errors.As(err, &unavailable) {
+		for _, reason := range unavailable.reasons {
+			if isTransientConnectError(reason) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// getRetryTimeout returns how long a client keeps retrying transient
+// connection failures, from AGE_PLUGIN_AGENT_RETRY_TIMEOUT (default: no retries)
+func getRetryTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv(RetryTimeoutEnvVar))
+	if err != nil || timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// connectAgentWithRetry calls connectAgent, retrying transient failures with
+// exponential backoff until the timeout has passed. Retries only ever happen
+// before the handshake succeeds, never once plugin data has been exchanged.
+func connectAgentWithRetry(pluginName string, opts handshakeOptions, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := retryInitialBackoff
+
+	for {
+		conn, err := connectAgent(pluginName, opts)
+		if err == nil || !isTransientConnectError(err) {
+			return conn, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logger.Debug("retrying agent connection", "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
 
-	// Close connection to stop the other goroutine
-	conn.Close()
+// runProxy implements the proxy subcommand. args are the arguments the
+// plugin was invoked with, which are needed to run the plugin locally.
+func runProxy(pluginName string, args []string) error {
+	// Pass on the state machine age asked for, the host age runs on for the
+	// audit trail, and how many agents this session already went through, as
+	// set by the server that started us
+	opts := handshakeOptions{
+		StateMachine: stateMachineFromArgs(args),
+		Via:          []string{localHostName()},
+	}
+	if hops, err := strconv.Atoi(os.Getenv(HopsEnvVar)); err == nil {
+		opts.Hops = hops
+	}
+
+	logger.Debug("proxy started", "plugin", pluginName, "args", args, "hops", opts.Hops, "version", Version)
+
+	// Connect to the first agent that accepts the plugin
+	conn, err := connectAgentWithRetry(pluginName, opts, getRetryTimeout())
+	if err != nil {
+		logger.Debug("no agent available", "err", err)
+		var unavailable *agentUnavailableError
+		if localFallbackEnabled() && errors.As(err, &unavailable) {
+			logger.Debug("falling back to local plugin")
+			return execLocalPlugin(pluginName, args)
+		}
+		return err
+	}
+	defer conn.Close()
 
-	// Wait for the second goroutine to finish
-	<-done
+	// Goroutine: stdin -> socket. When age closes stdin, half-close the
+	// socket so the plugin sees EOF while its remaining output still arrives.
+	go func() {
+		n, err := io.Copy(conn, os.Stdin)
+		logger.Debug("stdin closed", "bytes", n, "err", err)
+		if unixConn, ok := conn.(*net.UnixConn); ok {
+			unixConn.CloseWrite()
+		}
+	}()
 
+	// Socket -> stdout, until the server closes the connection after the
+	// plugin exits. The close shows up as a reset if the plugin exited
+	// without reading all of its input, which still ends the session normally.
+	n, err := io.Copy(os.Stdout, conn)
+	logger.Debug("agent closed session", "bytes", n, "err", err)
+	if errors.Is(err, syscall.ECONNRESET) {
+		return nil
+	}
 	return err
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -52,7 +53,7 @@ func TestPerformClientHandshake(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.pluginName == "../../../etc/passwd" {
 				// Client-side validation should fail before connection
-				err := performClientHandshake(nil, tt.pluginName)
+				err := performClientHandshake(nil, tt.pluginName, handshakeOptions{})
 				if (err != nil) != tt.wantErr {
 					t.Errorf("performClientHandshake() error = %v, wantErr %v", err, tt.wantErr)
 				}
@@ -101,7 +102,7 @@ func TestPerformClientHandshake(t *testing.T) {
 			defer conn.Close()
 
 			// Perform handshake
-			err = performClientHandshake(conn, tt.pluginName)
+			err = performClientHandshake(conn, tt.pluginName, handshakeOptions{})
 
 			// Wait for server to finish
 			select {
@@ -121,3 +122,113 @@ func TestPerformClientHandshake(t *testing.T) {
 		})
 	}
 }
+
+func TestStateMachineFromArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"identity", []string{"--age-plugin=identity-v1"}, "identity-v1"},
+		{"recipient among other args", []string{"-v", "--age-plugin=recipient-v1"}, "recipient-v1"},
+		{"no state machine", []string{"--generate"}, ""},
+		{"no args", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stateMachineFromArgs(tt.args); got != tt.want {
+				t.Errorf("stateMachineFromArgs(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTransientConnectError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "socket missing",
+			err:  &agentUnavailableError{reasons: []error{fmt.Errorf("dial: %w", syscall.ENOENT)}},
+			want: true,
+		},
+		{
+			name: "connection refused",
+			err:  &agentUnavailableError{reasons: []error{fmt.Errorf("dial: %w", syscall.ECONNREFUSED)}},
+			want: true,
+		},
+		{
+			name: "plugin not found everywhere",
+			err:  &agentUnavailableError{reasons: []error{fmt.Errorf("server error: plugin not found: x")}},
+			want: false,
+		},
+		{
+			name: "one candidate may come back",
+			err: &agentUnavailableError{reasons: []error{
+				fmt.Errorf("server error: plugin not found: x"),
+				fmt.Errorf("dial: %w", syscall.ECONNREFUSED),
+			}},
+			want: true,
+		},
+		{
+			name: "agent locked",
+			err:  fmt.Errorf("server error: agent locked"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientConnectError(tt.err); got != tt.want {
+				t.Errorf("isTransientConnectError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectAgentWithRetry(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "agent.sock")
+	t.Setenv("AGE_PLUGIN_AGENT_SOCKET", socketPath)
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("HOME", dir)
+
+	t.Run("gives up after the timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := connectAgentWithRetry("test", handshakeOptions{}, 300*time.Millisecond)
+		if err == nil {
+			t.Fatalf("connectAgentWithRetry() should fail without a server")
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("connectAgentWithRetry() returned after %s, want about 300ms", elapsed)
+		}
+	})
+
+	t.Run("connects once the socket appears", func(t *testing.T) {
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			listener, err := net.Listen("unix", socketPath)
+			if err != nil {
+				return
+			}
+			defer listener.Close()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("OK\n"))
+		}()
+
+		conn, err := connectAgentWithRetry("test", handshakeOptions{}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("connectAgentWithRetry() error = %v", err)
+		}
+		conn.Close()
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"age-plugin-agent/internal/bech32"
+	"filippo.io/age"
+)
+
+// agentRecipient returns the recipient string that encrypts to a recipient
+// group defined on the agent, e.g. age -r age1agent1...
+func agentRecipient(group string) string {
+	// Only the human-readable part can fail to encode, and it is fixed
+	recipient, _ := bech32.EncodePluginRecipient(AgentPluginName, []byte(group))
+	return recipient
+}
+
+// parseRecipientGroup parses the members of a recipient group
+func parseRecipientGroup(members []string) ([]*age.X25519Recipient, error) {
+	recipients := make([]*age.X25519Recipient, 0, len(members))
+	for _, member := range members {
+		recipient, err := age.ParseX25519Recipient(member)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// resolveAgentRecipient returns the members of the recipient group an
+// agent plugin recipient refers to
+func (s *Server) resolveAgentRecipient(encoded string) (string, []*age.X25519Recipient, error) {
+	key, err := bech32.ParseKey(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	if key.Kind != bech32.PluginRecipient || key.Plugin != AgentPluginName {
+		return "", nil, fmt.Errorf("not an agent plugin recipient")
+	}
+
+	group := string(key.Data)
+	members, ok := s.config.RecipientGroups[group]
+	if !ok {
+		return group, nil, fmt.Errorf("unknown recipient group %q", group)
+	}
+	recipients, err := parseRecipientGroup(members)
+	return group, recipients, err
+}
+
+// serveAgentRecipients runs the recipient-v1 state machine, wrapping file
+// keys for the members of recipient groups defined in the server config
+func (s *Server) serveAgentRecipients(t *protocolTap, sess *session) error {
+	// Phase 1: age sends the recipients and the file keys to wrap
+	var recipients []string
+	var fileKeys [][]byte
+	defer func() {
+		for _, fileKey := range fileKeys {
+			wipe(fileKey)
+		}
+	}()
+
+	for done := false; !done; {
+		stanza, err := t.fromAge()
+		if err != nil {
+			return err
+		}
+
+		switch stanza.Type {
+		case "add-recipient":
+			if len(stanza.Args) != 1 {
+				return fmt.Errorf("malformed add-recipient command")
+			}
+			recipients = append(recipients, stanza.Args[0])
+		case "wrap-file-key":
+			fileKeys = append(fileKeys, stanza.Body)
+		case "done":
+			done = true
+		default:
+			// Unknown commands, including grease and identities, are ignored
+		}
+	}
+
+	// Resolve every group before wrapping anything, so that an unknown group
+	// fails the whole encryption
+	var members []*age.X25519Recipient
+	for i, recipient := range recipients {
+		group, groupMembers, err := s.resolveAgentRecipient(recipient)
+		if err != nil {
+			sess.log.Warn("failed to resolve recipient", "group", group, "err", err)
+			t.sendError(&Stanza{Type: "error", Args: []string{"recipient", strconv.Itoa(i)}, Body: []byte(err.Error())})
+			return nil
+		}
+		sess.log.Info("encrypting to recipient group", "group", group, "members", len(groupMembers))
+		members = append(members, groupMembers...)
+	}
+
+	// Phase 2: send the stanzas of every member for every file key
+	for fileIndex, fileKey := range fileKeys {
+		for _, member := range members {
+			stanzas, err := member.Wrap(fileKey)
+			if err != nil {
+				return fmt.Errorf("failed to wrap file key: %w", err)
+			}
+			for _, stanza := range stanzas {
+				args := append([]string{strconv.Itoa(fileIndex), stanza.Type}, stanza.Args...)
+				if _, err := t.ask(&Stanza{Type: "recipient-stanza", Args: args, Body: stanza.Body}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return t.toAge(&Stanza{Type: "done"})
+}
+
+// recipientGroups describes the recipient groups in the server config
+func (s *Server) recipientGroups() []RecipientGroupInfo {
+	groups := make([]RecipientGroupInfo, 0, len(s.config.RecipientGroups))
+	for _, name := range sortedKeys(s.config.RecipientGroups) {
+		groups = append(groups, RecipientGroupInfo{
+			Name:      name,
+			Recipient: agentRecipient(name),
+			Members:   s.config.RecipientGroups[name],
+		})
+	}
+	return groups
+}
+
+// runGroups implements the groups subcommand
+func runGroups() error {
+	var groups []RecipientGroupInfo
+	if err := dialControl("groups", nil, &groups); err != nil {
+		return err
+	}
+
+	if len(groups) == 0 {
+		fmt.Println("The agent has no recipient groups")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tMEMBERS\tRECIPIENT")
+	for _, group := range groups {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", group.Name, len(group.Members), group.Recipient)
+	}
+	return tw.Flush()
+}
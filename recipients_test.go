@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// runAgentRecipients plays age's side of a recipient-v1 session against the
+// virtual agent plugin and returns the commands the plugin sent
+func runAgentRecipients(t *testing.T, server *Server, recipient string, fileKey []byte) []*Stanza {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	sess := server.sessions.add(AgentPluginName, "test")
+	req := &handshakeRequest{PluginName: AgentPluginName, Options: handshakeOptions{StateMachine: "recipient-v1"}}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.serveAgentPlugin(serverConn, req, sess)
+		serverConn.Close()
+	}()
+
+	go func() {
+		writeStanza(clientConn, &Stanza{Type: "add-recipient", Args: []string{recipient}})
+		writeStanza(clientConn, &Stanza{Type: "wrap-file-key", Body: fileKey})
+		writeStanza(clientConn, &Stanza{Type: "extension-labels"})
+		writeStanza(clientConn, &Stanza{Type: "done"})
+	}()
+
+	var commands []*Stanza
+	reader := bufio.NewReader(clientConn)
+	for {
+		command, err := readStanza(reader)
+		if err != nil {
+			t.Fatalf("failed to read plugin command: %v", err)
+		}
+		commands = append(commands, command)
+		if command.Type == "done" {
+			break
+		}
+		writeStanza(clientConn, &Stanza{Type: "ok"})
+		if command.Type == "error" {
+			break
+		}
+	}
+
+	if err := <-errChan; err != nil {
+		t.Fatalf("serveAgentPlugin() error = %v", err)
+	}
+	return commands
+}
+
+func TestServeAgentRecipients(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(&Config{RecipientGroups: map[string][]string{
+		"team-prod": {alice.Recipient().String(), bob.Recipient().String()},
+	}})
+	fileKey := bytes.Repeat([]byte{9}, 16)
+
+	commands := runAgentRecipients(t, server, agentRecipient("team-prod"), fileKey)
+	if len(commands) != 3 || commands[2].Type != "done" {
+		t.Fatalf("expected two recipient stanzas and done, got %d commands", len(commands))
+	}
+
+	for i, identity := range []*age.X25519Identity{alice, bob} {
+		command := commands[i]
+		if command.Type != "recipient-stanza" || command.Args[0] != "0" {
+			t.Fatalf("unexpected command: -> %s %v", command.Type, command.Args)
+		}
+		stanza := &age.Stanza{Type: command.Args[1], Args: command.Args[2:], Body: command.Body}
+		unwrapped, err := identity.Unwrap([]*age.Stanza{stanza})
+		if err != nil {
+			t.Fatalf("member %d can't unwrap its stanza: %v", i, err)
+		}
+		if !bytes.Equal(unwrapped, fileKey) {
+			t.Errorf("member %d unwrapped %x, want %x", i, unwrapped, fileKey)
+		}
+	}
+}
+
+func TestServeAgentRecipientsUnknownGroup(t *testing.T) {
+	server := newServer(&Config{})
+
+	commands := runAgentRecipients(t, server, agentRecipient("team-dev"), bytes.Repeat([]byte{9}, 16))
+	if len(commands) != 1 || commands[0].Type != "error" || commands[0].Args[0] != "recipient" {
+		t.Fatalf("expected a recipient error, got %v", commands)
+	}
+}
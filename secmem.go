@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mlockWarning makes sure the warning about swappable memory is logged once
+var mlockWarning sync.Once
+
+// lockedBuffer holds a secret outside the Go heap, locked into RAM so it never
+// reaches swap, and wipes it when destroyed. This only covers the stored copy:
+// copies made while using the secret stay on the heap until they are reused.
+type lockedBuffer struct {
+	data   []byte
+	mapped []byte
+}
+
+// newLockedBuffer copies secret into a new locked buffer. If the memory
+// can't be locked, e.g. because of RLIMIT_MEMLOCK, the buffer still works
+// and a warning is logged.
+func newLockedBuffer(secret []byte) (*lockedBuffer, error) {
+	pageSize := os.Getpagesize()
+	size := (len(secret) + pageSize - 1) / pageSize * pageSize
+	if size == 0 {
+		size = pageSize
+	}
+
+	mapped, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate secret memory: %w", err)
+	}
+	if err := unix.Mlock(mapped); err != nil {
+		mlockWarning.Do(func() {
+			logger.Warn("failed to lock secret memory, identities may be written to swap", "err", err)
+		})
+	}
+
+	b := &lockedBuffer{data: mapped[:len(secret)], mapped: mapped}
+	copy(b.data, secret)
+	return b, nil
+}
+
+// destroy wipes and releases the buffer
+func (b *lockedBuffer) destroy() {
+	if b.mapped == nil {
+		return
+	}
+	wipe(b.mapped)
+	unix.Munlock(b.mapped)
+	unix.Munmap(b.mapped)
+	b.data, b.mapped = nil, nil
+}
+
+// wipe overwrites a secret with zeros
+func wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
@@ -2,131 +2,444 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-// findPluginBinary searches $PATH for the age plugin binary
+// findPluginBinary searches $PATH for the age plugin binary. Intercept shims
+// pointing back at this executable are skipped, since running one would make
+// the server proxy to itself forever.
 func findPluginBinary(pluginName string) (string, error) {
 	binaryName := "age-plugin-" + pluginName
 
 	// Search for binary in PATH
-	path, err := exec.LookPath(binaryName)
-	if err != nil {
-		return "", fmt.Errorf("plugin not found: %s", pluginName)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, binaryName)
+
+		// Follow symlinks and skip anything that isn't an executable file
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+
+		if isOwnExecutable(info) {
+			continue
+		}
+
+		return path, nil
 	}
 
-	// Verify it's executable
-	info, err := os.Stat(path)
-	if err != nil {
-		return "", fmt.Errorf("plugin not found: %s", pluginName)
+	return "", fmt.Errorf("plugin not found: %s", pluginName)
+}
+
+// findAvailablePlugins lists the plugins on $PATH in the order of $PATH, with
+// earlier entries shadowing later ones. Unless includeShims is set, intercept
+// shims are skipped like findPluginBinary does.
+func findAvailablePlugins(includeShims bool) []PluginInfo {
+	seen := make(map[string]bool)
+	var plugins []PluginInfo
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			pluginName, ok := getPluginNameFromBinaryName(entry.Name())
+			if !ok || seen[pluginName] || validatePluginName(pluginName) != nil {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+			if !includeShims && isOwnExecutable(info) {
+				continue
+			}
+
+			seen[pluginName] = true
+			plugins = append(plugins, PluginInfo{Name: pluginName, Path: path})
+		}
 	}
 
-	// Check if it's executable
-	if info.Mode()&0111 == 0 {
-		return "", fmt.Errorf("plugin not executable: %s", path)
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+// pluginVersion asks a plugin binary for its version, returning an empty
+// string if the plugin does not answer --version promptly
+func pluginVersion(pluginPath string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, pluginPath, "--version").Output()
+	if err != nil {
+		return ""
 	}
 
-	return path, nil
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return version
+}
+
+// handshakeRequest is the parsed first line a client sends to the server
+type handshakeRequest struct {
+	// Command is set when the client sent a control command instead of a plugin name
+	Command string
+	Args    []string
+
+	PluginName string
+	PluginPath string
+	Options    handshakeOptions
+
+	// Upstream is the connection to the upstream agent serving the plugin,
+	// if the plugin is configured to be forwarded
+	Upstream net.Conn
+}
+
+// lockedControlCommands are the control commands answered while the agent is locked
+var lockedControlCommands = map[string]bool{
+	"status": true,
+	"unlock": true,
 }
 
 // performServerHandshake handles the server side of the handshake protocol
-func performServerHandshake(conn net.Conn) (string, error) {
+func (s *Server) performServerHandshake(conn net.Conn) (*handshakeRequest, error) {
 	// Set read timeout for handshake
 	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
-		return "", fmt.Errorf("failed to set read deadline: %w", err)
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
 	}
 
 	// Read plugin name
 	reader := bufio.NewReader(conn)
 	pluginNameLine, err := reader.ReadString('\n')
 	if err != nil {
-		return "", fmt.Errorf("failed to read plugin name: %w", err)
+		return nil, fmt.Errorf("failed to read plugin name: %w", err)
+	}
+
+	// Control commands are answered by the server itself
+	if strings.HasPrefix(pluginNameLine, ControlPrefix) {
+		fields := strings.Fields(strings.TrimPrefix(pluginNameLine, ControlPrefix))
+		if len(fields) == 0 {
+			conn.Write([]byte("ERROR empty control command\n"))
+			return nil, fmt.Errorf("empty control command")
+		}
+		if s.lock.isLocked() && !lockedControlCommands[fields[0]] {
+			conn.Write([]byte("ERROR agent locked\n"))
+			return nil, fmt.Errorf("agent locked, rejected control command: %s", fields[0])
+		}
+		conn.SetReadDeadline(time.Time{})
+		return &handshakeRequest{Command: fields[0], Args: fields[1:]}, nil
 	}
 
-	pluginName := strings.TrimSpace(pluginNameLine)
+	fields := strings.Fields(pluginNameLine)
+	pluginName := ""
+	if len(fields) > 0 {
+		pluginName = fields[0]
+	}
+
+	if s.lock.isLocked() {
+		conn.Write([]byte("ERROR agent locked\n"))
+		return nil, fmt.Errorf("agent locked, rejected plugin: %s", pluginName)
+	}
 
 	// Validate plugin name
 	if err := validatePluginName(pluginName); err != nil {
 		errMsg := fmt.Sprintf("ERROR invalid plugin name: %s\n", pluginName)
 		conn.Write([]byte(errMsg))
-		return "", fmt.Errorf("invalid plugin name: %s", pluginName)
+		return nil, fmt.Errorf("invalid plugin name: %s", pluginName)
+	}
+
+	opts, err := parseHandshakeOptions(fields[1:])
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+		return nil, err
+	}
+
+	// Refuse sessions that went through too many agents, which happens when
+	// agents end up forwarding to each other
+	if opts.Hops >= MaxHops {
+		conn.Write([]byte(fmt.Sprintf("ERROR too many hops: session passed through %d agents\n", opts.Hops)))
+		return nil, fmt.Errorf("too many hops for plugin %s: %d", pluginName, opts.Hops)
+	}
+
+	// Plugins configured with an upstream agent are forwarded to it. The
+	// upstream handshake happens first so its errors reach the client.
+	if upstreamPath, ok := s.config.Upstreams[pluginName]; ok {
+		upstream, err := dialUpstream(upstreamPath, pluginName, opts)
+		if err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+			return nil, err
+		}
+
+		if _, err := conn.Write([]byte("OK\n")); err != nil {
+			upstream.Close()
+			return nil, fmt.Errorf("failed to send OK response: %w", err)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		return &handshakeRequest{PluginName: pluginName, Options: opts, Upstream: upstream}, nil
+	}
+
+	// The agent plugin is served from the identities held in memory
+	if pluginName == AgentPluginName {
+		if !agentStateMachines[opts.StateMachine] {
+			conn.Write([]byte(fmt.Sprintf("ERROR the agent plugin does not support state machine %q\n", opts.StateMachine)))
+			return nil, fmt.Errorf("unsupported state machine for the agent plugin: %q", opts.StateMachine)
+		}
+
+		if _, err := conn.Write([]byte("OK\n")); err != nil {
+			return nil, fmt.Errorf("failed to send OK response: %w", err)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		return &handshakeRequest{PluginName: pluginName, Options: opts}, nil
 	}
 
 	// Search for plugin binary
 	pluginPath, err := findPluginBinary(pluginName)
 	if err != nil {
-		var errMsg string
-		if strings.Contains(err.Error(), "not found") {
-			errMsg = fmt.Sprintf("ERROR plugin not found: %s\n", pluginName)
-		} else if strings.Contains(err.Error(), "not executable") {
-			errMsg = fmt.Sprintf("ERROR plugin not executable: %s\n", pluginPath)
-		} else {
-			errMsg = fmt.Sprintf("ERROR %s\n", err.Error())
-		}
-		conn.Write([]byte(errMsg))
-		return "", err
+		// Non-executable files are skipped, so not found is the only failure
+		conn.Write([]byte(fmt.Sprintf("ERROR plugin not found: %s\n", pluginName)))
+		return nil, err
 	}
 
 	// Send OK response
 	if _, err := conn.Write([]byte("OK\n")); err != nil {
-		return "", fmt.Errorf("failed to send OK response: %w", err)
+		return nil, fmt.Errorf("failed to send OK response: %w", err)
 	}
 
 	// Clear read deadline for data proxying
 	conn.SetReadDeadline(time.Time{})
 
-	return pluginPath, nil
+	return &handshakeRequest{PluginName: pluginName, PluginPath: pluginPath, Options: opts}, nil
+}
+
+// Server holds the state shared by all connections of a running agent
+type Server struct {
+	config   *Config
+	started  time.Time
+	sessions *sessionRegistry
+	lock     *agentLock
+	// identities are served by the virtual agent plugin
+	identities *identityStore
+	// stubs holds the plugin identities that identity stubs refer to
+	stubs *stubStore
+	// pins answers plugins' PIN requests on the agent
+	pins *pinStore
+	// promptMu serializes passphrase prompts on the agent side
+	promptMu sync.Mutex
+
+	// shutdown is closed when a control command asks the server to stop
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
-// handleConnection handles a single client connection (stub for now)
-func handleConnection(conn net.Conn) {
+// newServer creates the server state for an agent with the given configuration
+func newServer(config *Config) *Server {
+	return &Server{
+		config:     config,
+		started:    time.Now(),
+		sessions:   newSessionRegistry(),
+		lock:       newAgentLock(),
+		identities: newIdentityStore(),
+		stubs:      newStubStore(),
+		pins:       newPinStore(),
+		shutdown:   make(chan struct{}),
+	}
+}
+
+// requestShutdown asks the accept loop to stop
+func (s *Server) requestShutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+}
+
+// handleConnection handles a single client connection
+func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	// Perform handshake
-	pluginPath, err := performServerHandshake(conn)
+	req, err := s.performServerHandshake(conn)
 	if err != nil {
 		// Error already sent to client
-		fmt.Fprintf(os.Stderr, "Handshake failed: %v\n", err)
+		logger.Warn("handshake failed", "peer", describePeer(conn), "err", err)
+		return
+	}
+
+	if req.Command != "" {
+		if err := s.handleControl(conn, req); err != nil {
+			logger.Warn("control command failed", "command", req.Command, "err", err)
+		}
 		return
 	}
 
-	fmt.Printf("Handshake successful, plugin: %s\n", pluginPath)
+	sess := s.sessions.add(req.PluginName, describePeer(conn))
+	sess.policy = newPolicySession(conn, req)
+	s.lock.touch()
+	defer func() {
+		s.sessions.remove(sess.id)
+		s.lock.touch()
+		sess.log.Info("session ended", "bytes_in", atomic.LoadInt64(&sess.bytesIn),
+			"bytes_out", atomic.LoadInt64(&sess.bytesOut))
+	}()
+
+	// Audit entry recording where the session came from at this hop
+	via := "direct"
+	if len(req.Options.Via) > 0 {
+		via = strings.Join(req.Options.Via, " -> ")
+	}
+	sess.log.Info("session started", "state_machine", req.Options.StateMachine,
+		"peer", sess.peer, "hop", req.Options.Hops, "via", via)
+
+	// Sessions the agent doesn't relay message by message are checked once
+	if req.Upstream != nil || req.PluginName == AgentPluginName || !tappedStateMachines[req.Options.StateMachine] {
+		if err := s.checkPolicy(sess, sess.policy, ""); err != nil {
+			denySession(conn, err)
+			return
+		}
+	}
+
+	if req.Upstream != nil {
+		sess.log.Info("forwarding to upstream agent", "upstream", s.config.Upstreams[req.PluginName])
+		if err := forwardToUpstream(conn, req.Upstream, sess); err != nil {
+			sess.log.Error("upstream proxy error", "err", err)
+		}
+		return
+	}
+
+	if req.PluginName == AgentPluginName {
+		if err := s.serveAgentPlugin(conn, req, sess); err != nil {
+			sess.log.Error("agent plugin error", "err", err)
+		}
+		return
+	}
+
+	if err := s.proxyToPlugin(conn, req, sess); err != nil {
+		sess.log.Error("plugin proxy error", "err", err)
+	}
+}
+
+// replaceTimeout is how long to wait for a replaced server to release its socket
+const replaceTimeout = 5 * time.Second
+
+// clearStaleSocket removes a socket left behind by a server that is no
+// longer running. If a server still answers, it fails unless replace is set,
+// in which case it asks that server to shut down and waits for it.
+func clearStaleSocket(socketPath string, replace bool) error {
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check existing socket: %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s: it is not a socket", socketPath)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		// Nobody is listening, the socket is stale
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+		return nil
+	}
+	defer conn.Close()
+
+	if !replace {
+		var status StatusResponse
+		if err := performControl(conn, "status", nil, &status); err == nil {
+			return fmt.Errorf("agent %s (up %s) is already listening on %s (use --replace to take over)",
+				status.Version, time.Since(status.Started).Round(time.Second), socketPath)
+		}
+		return fmt.Errorf("another process is already listening on %s", socketPath)
+	}
+
+	if err := performControl(conn, "shutdown", nil, nil); err != nil {
+		return fmt.Errorf("failed to ask the running agent to shut down: %w", err)
+	}
 
-	// Proxy to plugin (will be implemented in Phase 6)
-	if err := proxyToPlugin(conn, pluginPath); err != nil {
-		fmt.Fprintf(os.Stderr, "Plugin proxy error: %v\n", err)
+	// The running server removes the socket file when it closes its listener
+	deadline := time.Now().Add(replaceTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Lstat(socketPath); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
+	return fmt.Errorf("running agent did not release %s within %s", socketPath, replaceTimeout)
 }
 
 // runServer implements the server subcommand
-func runServer(socketPath string) error {
-	// Remove existing socket file
-	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove existing socket: %w", err)
+func runServer(config *Config) error {
+	socketPath := config.SocketPath
+
+	// Make sure nobody else can squat or replace the socket
+	if err := prepareSocketDir(socketPath); err != nil {
+		return err
 	}
 
+	// Agents started by earlier versions listen on the old default path
+	if legacyPath := legacySocketPath(); legacyPath != "" && legacyPath != socketPath {
+		if info, err := os.Lstat(legacyPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			logger.Warn("a socket exists at the old default path; update AGE_PLUGIN_AGENT_SOCKET or SSH RemoteForward settings that use it",
+				"old", legacyPath, "default", getSocketPath())
+		}
+	}
+
+	// Never steal the socket from a running agent
+	if err := clearStaleSocket(socketPath, config.Replace); err != nil {
+		return err
+	}
+
+	server := newServer(config)
+
 	// Create Unix domain socket listener
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		return fmt.Errorf("failed to create socket listener: %w", err)
 	}
+	// Closing the listener also removes the socket file. Don't remove it by
+	// path on exit: a server replacing this one may already listen there.
 	defer listener.Close()
-	defer os.Remove(socketPath)
 
 	// Set socket permissions
 	if err := os.Chmod(socketPath, 0600); err != nil {
 		return fmt.Errorf("failed to set socket permissions: %w", err)
 	}
 
-	fmt.Printf("Server started, listening on: %s\n", socketPath)
+	logger.Info("server started", "socket", socketPath, "version", Version)
+
+	if config.LockIdle > 0 {
+		// Only a lock command sets the passphrase that idle locking uses
+		logger.Warn("--lock-idle has no effect until a lock passphrase is set with age-plugin-agent lock", "idle", config.LockIdle)
+		go server.watchIdle(config.LockIdle)
+	}
+	if config.LockCommand != "" {
+		go server.watchLockCommand(config.LockCommand)
+	}
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -135,10 +448,14 @@ func runServer(socketPath string) error {
 	// Channel to signal server to stop
 	stopChan := make(chan bool, 1)
 
-	// Goroutine to handle signals
+	// Goroutine to handle signals and shutdown requests
 	go func() {
-		<-sigChan
-		fmt.Println("\nReceived shutdown signal, stopping server...")
+		select {
+		case <-sigChan:
+			logger.Info("received shutdown signal, stopping server")
+		case <-server.shutdown:
+			logger.Info("shutdown requested by control command, stopping server")
+		}
 		stopChan <- true
 		listener.Close()
 	}()
@@ -147,7 +464,7 @@ func runServer(socketPath string) error {
 	for {
 		select {
 		case <-stopChan:
-			fmt.Println("Server stopped")
+			logger.Info("server stopped")
 			return nil
 		default:
 			// Set a timeout for Accept to allow checking stopChan
@@ -156,19 +473,29 @@ func runServer(socketPath string) error {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
 					return nil
 				}
-				fmt.Fprintf(os.Stderr, "Accept error: %v\n", err)
+				logger.Error("accept error", "err", err)
 			} else {
-				fmt.Printf("Connection accepted from client\n")
-				go handleConnection(conn)
+				logger.Debug("connection accepted", "peer", describePeer(conn))
+				go server.handleConnection(conn)
 			}
 		}
 	}
 }
 
 // proxyToPlugin spawns the plugin subprocess and proxies data bidirectionally
-func proxyToPlugin(conn net.Conn, pluginPath string) error {
-	// Create command for the plugin
-	cmd := exec.Command(pluginPath)
+func (s *Server) proxyToPlugin(conn net.Conn, req *handshakeRequest, sess *session) error {
+	pluginPath := req.PluginPath
+
+	// Create command for the plugin, passing on the state machine age asked for
+	var args []string
+	if req.Options.StateMachine != "" {
+		args = append(args, "--age-plugin="+req.Options.StateMachine)
+	}
+	cmd := exec.Command(pluginPath, args...)
+
+	// If the plugin turns out to be an intercept shim for another agent, its
+	// proxy passes the incremented hop count on
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", HopsEnvVar, req.Options.Hops+1))
 
 	// Set up stdin pipe
 	pluginStdin, err := cmd.StdinPipe()
@@ -185,50 +512,74 @@ func proxyToPlugin(conn net.Conn, pluginPath string) error {
 	// Connect stderr to our stderr for debugging
 	cmd.Stderr = os.Stderr
 
+	// Run the plugin in its own process group so a cancelled session can
+	// take down any helpers the plugin spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
 	// Start the plugin process
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start plugin: %w", err)
 	}
-
-	fmt.Printf("Plugin started: %s (PID: %d)\n", pluginPath, cmd.Process.Pid)
-
-	// Channel to collect errors from goroutines
-	done := make(chan error, 2)
-
-	// Goroutine 1: socket -> plugin stdin
-	go func() {
-		_, err := io.Copy(pluginStdin, conn)
+	sess.setProcess(cmd.Process)
+
+	sess.log.Info("plugin started", "path", pluginPath, "pid", cmd.Process.Pid)
+
+	var outErr, relayErr error
+	var inDone chan error
+	if tappedStateMachines[req.Options.StateMachine] {
+		// Relay age's plugin protocol stanza by stanza, so that the agent
+		// can take part in it. The relay may be waiting for age rather than
+		// the plugin, so cancelling the session closes the connection too.
+		sess.setUpstream(conn)
+		relayErr = s.relayProtocol(conn, pluginStdin, pluginStdout, req, sess)
 		pluginStdin.Close()
-		done <- err
-	}()
-
-	// Goroutine 2: plugin stdout -> socket
-	go func() {
-		_, err := io.Copy(conn, pluginStdout)
-		done <- err
-	}()
+		if relayErr != nil && !sess.isCancelled() {
+			// The plugin may still be waiting for age, which is gone or gave up
+			signalProcessGroup(cmd.Process, syscall.SIGTERM)
+		}
+	} else {
+		// Goroutine: socket -> plugin stdin
+		inDone = make(chan error, 1)
+		go func() {
+			_, err := io.Copy(pluginStdin, &countingReader{r: conn, count: &sess.bytesIn})
+			pluginStdin.Close()
+			inDone <- err
+		}()
+
+		// Plugin stdout -> socket, until the plugin closes its stdout. This
+		// must finish before Wait, which closes the pipe.
+		_, outErr = io.Copy(conn, &countingReader{r: pluginStdout, count: &sess.bytesOut})
+	}
 
 	// Wait for plugin process to exit
 	processErr := cmd.Wait()
 
-	// Close connection to stop goroutines
-	conn.Close()
+	sess.tellCancelled(conn)
 
-	// Collect errors from goroutines
-	err1 := <-done
-	err2 := <-done
+	// Close connection to stop the other goroutine
+	conn.Close()
+	var inErr error
+	if inDone != nil {
+		inErr = <-inDone
+	}
 
-	fmt.Printf("Plugin exited: %s (PID: %d)\n", pluginPath, cmd.Process.Pid)
+	sess.log.Info("plugin exited", "path", pluginPath, "pid", cmd.Process.Pid, "exit_code", cmd.ProcessState.ExitCode())
 
 	// Return first non-nil error
-	if processErr != nil {
+	if sess.isCancelled() {
+		return fmt.Errorf("session %d cancelled", sess.id)
+	}
+	if relayErr != nil && !errors.Is(relayErr, errClientRefused) && !errors.Is(relayErr, errPolicyDenied) {
+		return relayErr
+	}
+	if processErr != nil && relayErr == nil {
 		return fmt.Errorf("plugin process error: %w", processErr)
 	}
-	if err1 != nil {
-		return fmt.Errorf("socket to plugin error: %w", err1)
+	if inErr != nil && !errors.Is(inErr, net.ErrClosed) {
+		return fmt.Errorf("socket to plugin error: %w", inErr)
 	}
-	if err2 != nil {
-		return fmt.Errorf("plugin to socket error: %w", err2)
+	if outErr != nil {
+		return fmt.Errorf("plugin to socket error: %w", outErr)
 	}
 
 	return nil
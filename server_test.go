@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindAvailablePlugins(t *testing.T) {
+	firstDir := t.TempDir()
+	secondDir := t.TempDir()
+
+	files := []struct {
+		dir  string
+		name string
+		mode os.FileMode
+	}{
+		{firstDir, "age-plugin-yubikey", 0755},
+		{firstDir, "age-plugin-agent", 0755},
+		{firstDir, "age-plugin-noexec", 0644},
+		{firstDir, "age-plugin-bad.name", 0755},
+		{firstDir, "unrelated", 0755},
+		{secondDir, "age-plugin-yubikey", 0755},
+		{secondDir, "age-plugin-tpm", 0755},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(f.dir, f.name), []byte("#!/bin/sh\n"), f.mode); err != nil {
+			t.Fatalf("failed to create %s: %v", f.name, err)
+		}
+	}
+
+	t.Setenv("PATH", firstDir+string(os.PathListSeparator)+secondDir)
+
+	plugins := findAvailablePlugins(false)
+
+	want := []PluginInfo{
+		{Name: "tpm", Path: filepath.Join(secondDir, "age-plugin-tpm")},
+		{Name: "yubikey", Path: filepath.Join(firstDir, "age-plugin-yubikey")},
+	}
+	if len(plugins) != len(want) {
+		t.Fatalf("findAvailablePlugins() = %v, want %v", plugins, want)
+	}
+	for i := range want {
+		if plugins[i] != want[i] {
+			t.Errorf("findAvailablePlugins()[%d] = %v, want %v", i, plugins[i], want[i])
+		}
+	}
+}
+
+func TestFindPluginBinarySkipsShims(t *testing.T) {
+	shimDir := t.TempDir()
+	realDir := t.TempDir()
+
+	exePath, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to get executable path: %v", err)
+	}
+	if err := os.Symlink(exePath, filepath.Join(shimDir, "age-plugin-test")); err != nil {
+		t.Fatalf("failed to create shim: %v", err)
+	}
+	realPlugin := filepath.Join(realDir, "age-plugin-test")
+	if err := os.WriteFile(realPlugin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	t.Setenv("PATH", shimDir+string(os.PathListSeparator)+realDir)
+
+	path, err := findPluginBinary("test")
+	if err != nil {
+		t.Fatalf("findPluginBinary() error = %v", err)
+	}
+	if path != realPlugin {
+		t.Errorf("findPluginBinary() = %q, want %q", path, realPlugin)
+	}
+
+	// With only the shim on PATH the plugin must not be found
+	t.Setenv("PATH", shimDir)
+	if path, err := findPluginBinary("test"); err == nil {
+		t.Errorf("findPluginBinary() = %q, want not found", path)
+	}
+}
+
+func TestClearStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing socket", func(t *testing.T) {
+		if err := clearStaleSocket(filepath.Join(dir, "missing.sock"), false); err != nil {
+			t.Errorf("clearStaleSocket() error = %v", err)
+		}
+	})
+
+	t.Run("regular file is never removed", func(t *testing.T) {
+		path := filepath.Join(dir, "regular")
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		if err := clearStaleSocket(path, true); err == nil {
+			t.Errorf("clearStaleSocket() should refuse to remove a regular file")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("regular file was removed")
+		}
+	})
+
+	t.Run("stale socket is removed", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Failed to create test listener: %v", err)
+		}
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+
+		if err := clearStaleSocket(path, false); err != nil {
+			t.Errorf("clearStaleSocket() error = %v", err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("stale socket was not removed")
+		}
+	})
+
+	t.Run("live agent", func(t *testing.T) {
+		path := filepath.Join(dir, "live.sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Failed to create test listener: %v", err)
+		}
+		defer listener.Close()
+
+		server := newServer(&Config{SocketPath: path})
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go server.handleConnection(conn)
+			}
+		}()
+		go func() {
+			<-server.shutdown
+			listener.Close()
+		}()
+
+		if err := clearStaleSocket(path, false); err == nil || !strings.Contains(err.Error(), "already listening") {
+			t.Errorf("clearStaleSocket() error = %v, want already listening", err)
+		}
+		if err := clearStaleSocket(path, true); err != nil {
+			t.Errorf("clearStaleSocket() with replace error = %v", err)
+		}
+	})
+}
+
+func TestProxyToPluginCancel(t *testing.T) {
+	// The plugin asks for a secret straight away and then waits, long after
+	// age stopped answering
+	plugin := filepath.Join(t.TempDir(), "age-plugin-test")
+	script := "#!/bin/sh\nprintf -- '-> request-secret\\nRW50ZXIgUElO\\n'\nexec sleep 30\n"
+	if err := os.WriteFile(plugin, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to create plugin: %v", err)
+	}
+
+	serverConn, ageConn := net.Pipe()
+	defer ageConn.Close()
+
+	// age sends phase 1 and never answers the request
+	asked := make(chan struct{})
+	go func() {
+		writeStanza(ageConn, &Stanza{Type: "add-identity", Args: []string{"AGE-PLUGIN-TEST-1"}})
+		writeStanza(ageConn, &Stanza{Type: "done"})
+		reader := bufio.NewReader(ageConn)
+		if _, err := readStanza(reader); err == nil {
+			close(asked)
+		}
+		io.Copy(io.Discard, reader)
+	}()
+
+	server := newServer(&Config{})
+	req := &handshakeRequest{PluginName: "test", PluginPath: plugin, Options: handshakeOptions{StateMachine: "identity-v1"}}
+	sess := server.sessions.add("test", "test")
+	proxied := make(chan error, 1)
+	go func() {
+		proxied <- server.proxyToPlugin(serverConn, req, sess)
+	}()
+
+	select {
+	case <-asked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plugin's request never reached age")
+	}
+	if err := server.sessions.cancel(sess.id); err != nil {
+		t.Fatalf("cancel() error = %v", err)
+	}
+
+	select {
+	case err := <-proxied:
+		if err == nil || !strings.Contains(err.Error(), "cancelled") {
+			t.Errorf("proxyToPlugin() error = %v, want cancelled", err)
+		}
+	case <-time.After(cancelGracePeriod / 2):
+		t.Fatal("proxyToPlugin() still running after cancel")
+	}
+}
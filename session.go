@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cancelGracePeriod is how long a cancelled plugin gets to exit before it is killed
+const cancelGracePeriod = 5 * time.Second
+
+// session tracks a single plugin session served by the agent
+type session struct {
+	// Byte counters come first so they stay 64-bit aligned for atomic access
+	bytesIn  int64
+	bytesOut int64
+
+	id      uint64
+	plugin  string
+	peer    string
+	started time.Time
+	// log tags every record with the session ID for correlation
+	log *slog.Logger
+	// policy tracks the session's messages for the policy
+	policy *policySession
+
+	mu        sync.Mutex
+	process   *os.Process
+	upstream  io.Closer
+	cancelled bool
+}
+
+// setProcess records the plugin process serving the session, terminating
+// it straight away if the session was cancelled while it was starting
+func (s *session) setProcess(process *os.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.process = process
+	if s.cancelled {
+		signalProcessGroup(process, syscall.SIGTERM)
+	}
+}
+
+// setUpstream records the upstream agent connection serving the session,
+// closing it straight away if the session was cancelled in the meantime
+func (s *session) setUpstream(upstream io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.upstream = upstream
+	if s.cancelled {
+		upstream.Close()
+	}
+}
+
+// isCancelled reports whether the session was cancelled
+func (s *session) isCancelled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancelled
+}
+
+// cancel terminates the plugin process, killing it if it does not exit
+// within the grace period
+func (s *session) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancelled = true
+	if s.upstream != nil {
+		s.upstream.Close()
+	}
+	if s.process == nil {
+		return
+	}
+
+	process := s.process
+	signalProcessGroup(process, syscall.SIGTERM)
+	time.AfterFunc(cancelGracePeriod, func() {
+		// Fails harmlessly if the process group is already gone
+		signalProcessGroup(process, syscall.SIGKILL)
+	})
+}
+
+// tellCancelled tells age why the plugin went away if the session was
+// cancelled. A connection cancel closed already doesn't get the message.
+func (s *session) tellCancelled(conn io.Writer) {
+	if s.isCancelled() {
+		writeStanza(conn, errorStanza(fmt.Sprintf("age-plugin-agent: session %d was cancelled on the agent", s.id)))
+	}
+}
+
+// signalProcessGroup signals a plugin and any children it spawned, which
+// would otherwise keep its stdout open after the plugin itself exits.
+// Plugins are started in their own process group for this.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) {
+	syscall.Kill(-process.Pid, sig)
+}
+
+// info returns a snapshot of the session suitable for reporting
+func (s *session) info() SessionInfo {
+	return SessionInfo{
+		ID:       s.id,
+		Plugin:   s.plugin,
+		Peer:     s.peer,
+		Started:  s.started,
+		BytesIn:  atomic.LoadInt64(&s.bytesIn),
+		BytesOut: atomic.LoadInt64(&s.bytesOut),
+	}
+}
+
+// sessionRegistry keeps track of the sessions currently running on the server
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+}
+
+// newSessionRegistry creates an empty session registry
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[uint64]*session)}
+}
+
+// add registers a new session and assigns it an ID
+func (r *sessionRegistry) add(plugin, peer string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	s := &session{
+		id:      r.nextID,
+		plugin:  plugin,
+		peer:    peer,
+		started: time.Now(),
+		log:     logger.With("session", r.nextID, "plugin", plugin),
+	}
+	r.sessions[s.id] = s
+	return s
+}
+
+// remove drops a session from the registry
+func (r *sessionRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// cancel cancels the session with the given ID
+func (r *sessionRegistry) cancel(id uint64) error {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such session: %d", id)
+	}
+
+	s.cancel()
+	return nil
+}
+
+// list returns a snapshot of all running sessions ordered by ID
+func (r *sessionRegistry) list() []SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// countingReader counts the bytes read through it into an atomic counter
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written through it into an atomic counter
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
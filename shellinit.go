@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultInstallDir returns the directory used for persistent intercept symlinks
+func defaultInstallDir() string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dataHome = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(dataHome, "age-plugin-agent", "bin")
+}
+
+// shellInitScript returns the snippet that puts dir first on PATH for the
+// given shell and exports socket, if one is configured. Without one it
+// leaves AGE_PLUGIN_AGENT_SOCKET alone, so the shims search the candidate
+// sockets whenever they run.
+func shellInitScript(shell, dir, socket string) (string, error) {
+	switch shell {
+	case "bash", "zsh", "sh":
+		quotedDir := quotePOSIX(dir)
+		script := fmt.Sprintf(`case ":$PATH:" in
+  *:%s:*) ;;
+  *) export PATH=%s:"$PATH" ;;
+esac
+`, quotedDir, quotedDir)
+		if socket != "" {
+			script += fmt.Sprintf("export AGE_PLUGIN_AGENT_SOCKET=%s\n", quotePOSIX(socket))
+		}
+		return script, nil
+	case "fish":
+		quotedDir := quoteFish(dir)
+		script := fmt.Sprintf(`contains -- %s $PATH; or set -gx PATH %s $PATH
+`, quotedDir, quotedDir)
+		if socket != "" {
+			script += fmt.Sprintf("set -gx AGE_PLUGIN_AGENT_SOCKET %s\n", quoteFish(socket))
+		}
+		return script, nil
+	default:
+		return "", fmt.Errorf("unsupported shell %q (supported: bash, zsh, fish)", shell)
+	}
+}
+
+// quotePOSIX single-quotes a string for POSIX shells
+func quotePOSIX(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// quoteFish single-quotes a string for fish
+func quoteFish(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "'", `\'`)
+	return "'" + s + "'"
+}
+
+// runShellInit implements the shell-init subcommand
+func runShellInit(shell, dir string) error {
+	if dir == "" {
+		dir = defaultInstallDir()
+		if dir == "" {
+			return fmt.Errorf("cannot determine install directory, pass one explicitly")
+		}
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	script, err := shellInitScript(shell, absDir, os.Getenv("AGE_PLUGIN_AGENT_SOCKET"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(script)
+	return nil
+}
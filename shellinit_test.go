@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShellInitScript(t *testing.T) {
+	tests := []struct {
+		name         string
+		shell        string
+		dir          string
+		socket       string
+		wantErr      bool
+		wantContains []string
+	}{
+		{
+			name:  "bash",
+			shell: "bash",
+			dir:   "/home/user/bin",
+			wantContains: []string{
+				`export PATH='/home/user/bin':"$PATH"`,
+			},
+		},
+		{
+			name:  "zsh with quote in directory",
+			shell: "zsh",
+			dir:   "/home/o'brien/bin",
+			wantContains: []string{
+				`export PATH='/home/o'\''brien/bin':"$PATH"`,
+			},
+		},
+		{
+			name:  "fish",
+			shell: "fish",
+			dir:   "/home/o'brien/bin",
+			wantContains: []string{
+				`set -gx PATH '/home/o\'brien/bin' $PATH`,
+			},
+		},
+		{
+			name:   "bash with a configured socket",
+			shell:  "bash",
+			dir:    "/home/user/bin",
+			socket: "/run/user/1000/age-plugin-agent/agent.sock:/home/user/.age-plugin-agent.sock",
+			wantContains: []string{
+				`export AGE_PLUGIN_AGENT_SOCKET='/run/user/1000/age-plugin-agent/agent.sock:/home/user/.age-plugin-agent.sock'`,
+			},
+		},
+		{
+			name:   "fish with a configured socket",
+			shell:  "fish",
+			dir:    "/home/user/bin",
+			socket: "/tmp/agent.sock",
+			wantContains: []string{
+				`set -gx AGE_PLUGIN_AGENT_SOCKET '/tmp/agent.sock'`,
+			},
+		},
+		{
+			name:    "unsupported shell",
+			shell:   "tcsh",
+			dir:     "/home/user/bin",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := shellInitScript(tt.shell, tt.dir, tt.socket)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("shellInitScript() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(script, want) {
+					t.Errorf("shellInitScript() = %q, should contain %q", script, want)
+				}
+			}
+			// Pinning a socket nobody configured would bypass the discovery
+			// of a working agent
+			if tt.socket == "" && strings.Contains(script, "AGE_PLUGIN_AGENT_SOCKET") {
+				t.Errorf("shellInitScript() = %q, should not set the socket", script)
+			}
+		})
+	}
+}
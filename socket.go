@@ -1,23 +1,151 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"syscall"
 )
 
 // getSocketPath determines the Unix domain socket path to use
 func getSocketPath() string {
-	// Check for environment variable first
+	// Check for environment variable first, which may hold a list of candidates
 	if socketPath := os.Getenv("AGE_PLUGIN_AGENT_SOCKET"); socketPath != "" {
-		return socketPath
+		return filepath.SplitList(socketPath)[0]
 	}
 
-	// Use default path in user's home directory
+	// Use the default path in a private directory
+	return filepath.Join(defaultSocketDir(), "agent.sock")
+}
+
+// defaultSocketDir returns the private directory holding the default socket:
+// $XDG_RUNTIME_DIR/age-plugin-agent, or a per-user directory under /tmp
+func defaultSocketDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "age-plugin-agent")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("age-plugin-agent-%d", os.Getuid()))
+}
+
+// legacySocketPath returns the default socket path of earlier versions
+func legacySocketPath() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		// Fallback to /tmp if home directory cannot be determined
-		return "/tmp/age-plugin-agent.sock"
+		return ""
 	}
-
 	return filepath.Join(homeDir, ".age-plugin-agent.sock")
 }
+
+// errStickySocketDir reports a socket directory that other users can create
+// files in, but that is sticky, like /tmp, so they can't replace ours
+var errStickySocketDir = errors.New("shared sticky directory")
+
+// prepareSocketDir creates the directory for the server socket with private
+// permissions if it doesn't exist, and checks that the socket is safe to use
+func prepareSocketDir(socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	return checkSocketPath(socketPath)
+}
+
+// checkSocketDir verifies that nobody but the current user (or root) can
+// create or replace files in the socket directory, so another user can't
+// squat the socket path. Sticky directories fail with errStickySocketDir.
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("socket directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if int(stat.Uid) != os.Getuid() && stat.Uid != 0 {
+			return fmt.Errorf("socket directory %s is owned by uid %d, not the current user", dir, stat.Uid)
+		}
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		if info.Mode()&os.ModeSticky != 0 {
+			return fmt.Errorf("socket directory %s is writable by other users: %w", dir, errStickySocketDir)
+		}
+		return fmt.Errorf("socket directory %s is writable by other users (mode %04o)", dir, info.Mode().Perm())
+	}
+
+	return nil
+}
+
+// checkSocketPath verifies that no other user can have created or replaced
+// the socket. Its directory must be private, or sticky with the socket
+// owned by the current user and closed to everyone else. A socket that
+// doesn't exist yet is fine: whoever creates it owns it.
+func checkSocketPath(socketPath string) error {
+	err := checkSocketDir(filepath.Dir(socketPath))
+	if !errors.Is(err, errStickySocketDir) {
+		return err
+	}
+
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("socket %s in a shared directory is not owned by the current user", socketPath)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("socket %s in a shared directory is accessible to other users (mode %04o)", socketPath, info.Mode().Perm())
+	}
+	return nil
+}
+
+// getSocketCandidates returns the sockets a client should try, in order:
+// the colon-separated AGE_PLUGIN_AGENT_SOCKET list, sockets in
+// $XDG_RUNTIME_DIR/age-plugin-agent, ~/.age-plugin-agent*.sock, which
+// includes the legacy default path and sockets forwarded over SSH next to
+// it, and finally the default path
+func getSocketCandidates() []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(paths ...string) {
+		for _, path := range paths {
+			if path != "" && !seen[path] {
+				seen[path] = true
+				candidates = append(candidates, path)
+			}
+		}
+	}
+
+	if socketPaths := os.Getenv("AGE_PLUGIN_AGENT_SOCKET"); socketPaths != "" {
+		add(filepath.SplitList(socketPaths)...)
+	}
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		add(globSorted(filepath.Join(runtimeDir, "age-plugin-agent", "*.sock"))...)
+	}
+
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		add(globSorted(filepath.Join(homeDir, ".age-plugin-agent*.sock"))...)
+	}
+
+	// Always try the default path, even if nothing exists there yet, so
+	// that errors mention where the socket was expected
+	add(getSocketPath())
+
+	return candidates
+}
+
+// globSorted returns the paths matching pattern in lexical order
+func globSorted(pattern string) []string {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil
+	}
+	sort.Strings(matches)
+	return matches
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -27,25 +29,194 @@ func TestGetSocketPath(t *testing.T) {
 		}
 	})
 
-	t.Run("without environment variable", func(t *testing.T) {
+	t.Run("with runtime directory", func(t *testing.T) {
 		os.Unsetenv("AGE_PLUGIN_AGENT_SOCKET")
+		t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
 
-		result := getSocketPath()
+		expectedPath := "/run/user/1000/age-plugin-agent/agent.sock"
+		if result := getSocketPath(); result != expectedPath {
+			t.Errorf("getSocketPath() = %q, want %q", result, expectedPath)
+		}
+	})
 
-		// Should return either home directory path or /tmp fallback
-		homeDir, err := os.UserHomeDir()
+	t.Run("without runtime directory", func(t *testing.T) {
+		os.Unsetenv("AGE_PLUGIN_AGENT_SOCKET")
+		t.Setenv("XDG_RUNTIME_DIR", "")
+
+		// Should use a per-user directory under /tmp
+		expectedPath := filepath.Join(os.TempDir(), fmt.Sprintf("age-plugin-agent-%d", os.Getuid()), "agent.sock")
+		if result := getSocketPath(); result != expectedPath {
+			t.Errorf("getSocketPath() = %q, want %q", result, expectedPath)
+		}
+	})
+}
+
+func TestCheckSocketDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(dir string) string
+		wantErr bool
+	}{
+		{
+			name:    "private directory",
+			setup:   func(dir string) string { os.Chmod(dir, 0700); return dir },
+			wantErr: false,
+		},
+		{
+			name:    "world writable directory",
+			setup:   func(dir string) string { os.Chmod(dir, 0777); return dir },
+			wantErr: true,
+		},
+		{
+			name:    "group writable directory",
+			setup:   func(dir string) string { os.Chmod(dir, 0770); return dir },
+			wantErr: true,
+		},
+		{
+			name: "symlink to directory",
+			setup: func(dir string) string {
+				link := filepath.Join(dir, "link")
+				os.Symlink(dir, link)
+				return link
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing directory",
+			setup:   func(dir string) string { return filepath.Join(dir, "missing") },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tt.setup(t.TempDir())
+			if err := checkSocketDir(dir); (err != nil) != tt.wantErr {
+				t.Errorf("checkSocketDir(%q) error = %v, wantErr %v", dir, err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("prepare creates private directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "age-plugin-agent")
+		if err := prepareSocketDir(filepath.Join(dir, "agent.sock")); err != nil {
+			t.Fatalf("prepareSocketDir() error = %v", err)
+		}
+		info, err := os.Stat(dir)
 		if err != nil {
-			// Should use /tmp fallback
-			expectedPath := "/tmp/age-plugin-agent.sock"
-			if result != expectedPath {
-				t.Errorf("getSocketPath() = %q, want %q", result, expectedPath)
+			t.Fatalf("socket directory not created: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0700 {
+			t.Errorf("socket directory mode = %04o, want 0700", perm)
+		}
+	})
+}
+
+func TestCheckSocketPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		dirMode    os.FileMode
+		socketMode os.FileMode
+		wantErr    bool
+	}{
+		{
+			name:    "private directory without socket",
+			dirMode: 0700,
+		},
+		{
+			name:    "sticky directory without socket",
+			dirMode: 0777 | os.ModeSticky,
+		},
+		{
+			name:       "private socket in sticky directory",
+			dirMode:    0777 | os.ModeSticky,
+			socketMode: 0600,
+		},
+		{
+			name:       "open socket in sticky directory",
+			dirMode:    0777 | os.ModeSticky,
+			socketMode: 0666,
+			wantErr:    true,
+		},
+		{
+			name:       "private socket in world writable directory",
+			dirMode:    0777,
+			socketMode: 0600,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			socketPath := filepath.Join(dir, "agent.sock")
+			if tt.socketMode != 0 {
+				// The checks only look at ownership and permissions
+				if err := os.WriteFile(socketPath, nil, tt.socketMode); err != nil {
+					t.Fatal(err)
+				}
+				os.Chmod(socketPath, tt.socketMode)
 			}
-		} else {
-			// Should use home directory
-			expectedPath := filepath.Join(homeDir, ".age-plugin-agent.sock")
-			if result != expectedPath {
-				t.Errorf("getSocketPath() = %q, want %q", result, expectedPath)
+			os.Chmod(dir, tt.dirMode)
+			defer os.Chmod(dir, 0700)
+
+			if err := checkSocketPath(socketPath); (err != nil) != tt.wantErr {
+				t.Errorf("checkSocketPath(%q) error = %v, wantErr %v", socketPath, err, tt.wantErr)
 			}
+		})
+	}
+}
+
+func TestGetSocketCandidates(t *testing.T) {
+	homeDir := t.TempDir()
+	runtimeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	agentDir := filepath.Join(runtimeDir, "age-plugin-agent")
+	if err := os.Mkdir(agentDir, 0700); err != nil {
+		t.Fatalf("failed to create runtime dir: %v", err)
+	}
+	for _, path := range []string{
+		filepath.Join(agentDir, "b.sock"),
+		filepath.Join(agentDir, "a.sock"),
+		filepath.Join(agentDir, "ignored.txt"),
+		filepath.Join(homeDir, ".age-plugin-agent-laptop.sock"),
+	} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatalf("failed to create %s: %v", path, err)
+		}
+	}
+
+	t.Run("with environment variable list", func(t *testing.T) {
+		t.Setenv("AGE_PLUGIN_AGENT_SOCKET", "/first.sock:/second.sock:/first.sock")
+
+		want := []string{
+			"/first.sock",
+			"/second.sock",
+			filepath.Join(agentDir, "a.sock"),
+			filepath.Join(agentDir, "b.sock"),
+			filepath.Join(homeDir, ".age-plugin-agent-laptop.sock"),
+		}
+		if got := getSocketCandidates(); !reflect.DeepEqual(got, want) {
+			t.Errorf("getSocketCandidates() = %q, want %q", got, want)
+		}
+		if got := getSocketPath(); got != "/first.sock" {
+			t.Errorf("getSocketPath() = %q, want %q", got, "/first.sock")
+		}
+	})
+
+	t.Run("without environment variable", func(t *testing.T) {
+		t.Setenv("AGE_PLUGIN_AGENT_SOCKET", "")
+
+		want := []string{
+			filepath.Join(agentDir, "a.sock"),
+			filepath.Join(agentDir, "b.sock"),
+			filepath.Join(homeDir, ".age-plugin-agent-laptop.sock"),
+			filepath.Join(agentDir, "agent.sock"),
+		}
+		if got := getSocketCandidates(); !reflect.DeepEqual(got, want) {
+			t.Errorf("getSocketCandidates() = %q, want %q", got, want)
 		}
 	})
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// stanzaColumns is the line length at which stanza bodies are wrapped
+const stanzaColumns = 64
+
+// Stanza is a single command of the age plugin protocol
+type Stanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// writeStanza encodes a stanza in the age plugin protocol wire format
+func writeStanza(w io.Writer, s *Stanza) error {
+	header := append([]string{"->", s.Type}, s.Args...)
+	if _, err := fmt.Fprintf(w, "%s\n", strings.Join(header, " ")); err != nil {
+		return err
+	}
+
+	// The body is unpadded base64 wrapped at 64 columns, terminated by a
+	// line shorter than 64 columns (which may be empty)
+	body := base64.RawStdEncoding.EncodeToString(s.Body)
+	for len(body) >= stanzaColumns {
+		if _, err := fmt.Fprintf(w, "%s\n", body[:stanzaColumns]); err != nil {
+			return err
+		}
+		body = body[stanzaColumns:]
+	}
+	_, err := fmt.Fprintf(w, "%s\n", body)
+	return err
+}
+
+// readStanza decodes a stanza in the age plugin protocol wire format
+func readStanza(r *bufio.Reader) (*Stanza, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(strings.TrimSuffix(header, "\n"), " ")
+	if len(fields) < 2 || fields[0] != "->" || fields[1] == "" {
+		return nil, fmt.Errorf("malformed stanza header: %q", header)
+	}
+	s := &Stanza{Type: fields[1], Args: fields[2:]}
+
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) > stanzaColumns {
+			return nil, fmt.Errorf("stanza body line too long")
+		}
+		chunk, err := base64.RawStdEncoding.Strict().DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stanza body: %w", err)
+		}
+		s.Body = append(s.Body, chunk...)
+
+		if len(line) < stanzaColumns {
+			return s, nil
+		}
+	}
+}
+
+// errorStanza builds an internal error command carrying a message for age to display
+func errorStanza(message string) *Stanza {
+	return &Stanza{Type: "error", Args: []string{"internal"}, Body: []byte(message)}
+}
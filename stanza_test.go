@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteStanza(t *testing.T) {
+	tests := []struct {
+		name   string
+		stanza *Stanza
+		want   string
+	}{
+		{
+			name:   "empty body",
+			stanza: &Stanza{Type: "done"},
+			want:   "-> done\n\n",
+		},
+		{
+			name:   "arguments and short body",
+			stanza: &Stanza{Type: "error", Args: []string{"internal"}, Body: []byte("boom")},
+			want:   "-> error internal\nYm9vbQ\n",
+		},
+		{
+			name:   "body of exactly one line",
+			stanza: &Stanza{Type: "msg", Body: bytes.Repeat([]byte{0}, 48)},
+			want:   "-> msg\n" + strings.Repeat("A", 64) + "\n\n",
+		},
+		{
+			name:   "body wrapping over two lines",
+			stanza: &Stanza{Type: "msg", Body: bytes.Repeat([]byte{0}, 51)},
+			want:   "-> msg\n" + strings.Repeat("A", 64) + "\n" + "AAAA\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeStanza(&buf, tt.stanza); err != nil {
+				t.Fatalf("writeStanza() error = %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("writeStanza() = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadStanza(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    *Stanza
+		wantErr bool
+	}{
+		{
+			name:  "empty body",
+			input: "-> done\n\n",
+			want:  &Stanza{Type: "done", Args: []string{}},
+		},
+		{
+			name:  "arguments and short body",
+			input: "-> error internal\nYm9vbQ\n",
+			want:  &Stanza{Type: "error", Args: []string{"internal"}, Body: []byte("boom")},
+		},
+		{
+			name:  "body wrapping over two lines",
+			input: "-> msg\n" + strings.Repeat("A", 64) + "\n" + "AAAA\n",
+			want:  &Stanza{Type: "msg", Args: []string{}, Body: bytes.Repeat([]byte{0}, 51)},
+		},
+		{
+			name:    "missing arrow",
+			input:   "done\n\n",
+			wantErr: true,
+		},
+		{
+			name:    "padded base64",
+			input:   "-> msg\nYm9vbQ==\n",
+			wantErr: true,
+		},
+		{
+			name:    "truncated body",
+			input:   "-> msg\n" + strings.Repeat("A", 64) + "\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readStanza(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readStanza() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readStanza() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"age-plugin-agent/internal/bech32"
+)
+
+// stubHandleSize is the size of the random handles of identities held for stubs
+const stubHandleSize = 16
+
+// Identity stubs are agent plugin identities whose data is the name of the
+// plugin they stand for, optionally followed by a NUL byte and the handle
+// of a plugin identity held by the agent. Without a handle the stub stands
+// for the plugin's default identity, like age -j <plugin>.
+
+// encodeStub returns the identity stub for a plugin and an optional handle
+func encodeStub(target string, handle []byte) string {
+	data := []byte(target)
+	if len(handle) > 0 {
+		data = append(append(data, 0), handle...)
+	}
+	// Can't fail, as in agentRecipient
+	stub, _ := bech32.EncodePluginIdentity(AgentPluginName, data)
+	return stub
+}
+
+// parseStub decodes an agent plugin identity into the plugin it stands for
+// and the handle of the held identity. Plain agent identities, which refer
+// to the identities held in memory, have an empty target.
+func parseStub(identity string) (string, []byte, error) {
+	key, err := bech32.ParseKey(identity)
+	if err != nil {
+		return "", nil, err
+	}
+	if key.Kind != bech32.PluginIdentity || key.Plugin != AgentPluginName {
+		return "", nil, fmt.Errorf("not an agent plugin identity")
+	}
+	if len(key.Data) == 0 {
+		return "", nil, nil
+	}
+
+	target, handle, _ := bytes.Cut(key.Data, []byte{0})
+	if err := validatePluginName(string(target)); err != nil || string(target) == AgentPluginName {
+		return "", nil, fmt.Errorf("invalid plugin name in identity stub")
+	}
+	return string(target), handle, nil
+}
+
+// stubStore holds the plugin identities that identity stubs refer to by
+// handle, in locked buffers like the agent's own identities
+type stubStore struct {
+	mu         sync.Mutex
+	identities map[string]*lockedBuffer
+}
+
+// newStubStore creates an empty stub store
+func newStubStore() *stubStore {
+	return &stubStore{identities: make(map[string]*lockedBuffer)}
+}
+
+// add holds a plugin identity and returns its new handle
+func (s *stubStore) add(identity string) ([]byte, error) {
+	handle := make([]byte, stubHandleSize)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, fmt.Errorf("failed to generate handle: %w", err)
+	}
+	buffer, err := newLockedBuffer([]byte(identity))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities[hex.EncodeToString(handle)] = buffer
+	return handle, nil
+}
+
+// lookup returns the plugin identity held under a handle. The plugin
+// protocol sends identities as strings, so this is a copy on the heap.
+func (s *stubStore) lookup(handle []byte) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buffer, ok := s.identities[hex.EncodeToString(handle)]
+	if !ok {
+		return "", false
+	}
+	return string(buffer.data), true
+}
+
+// removeAll wipes every held plugin identity and returns how many there were
+func (s *stubStore) removeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.identities)
+	for handle, buffer := range s.identities {
+		buffer.destroy()
+		delete(s.identities, handle)
+	}
+	return n
+}
+
+// resolveAgentIdentity returns the plugin and plugin identity an agent
+// plugin identity stands for, or an empty target for identities held in memory
+func (s *Server) resolveAgentIdentity(encoded string) (string, string, error) {
+	target, handle, err := parseStub(encoded)
+	if err != nil || target == "" {
+		return "", "", err
+	}
+
+	if len(handle) == 0 {
+		// parseStub validated the plugin name
+		identity, _ := bech32.EncodePluginIdentity(target, nil)
+		return target, identity, nil
+	}
+	identity, ok := s.stubs.lookup(handle)
+	if !ok {
+		return "", "", fmt.Errorf("the agent does not hold the %s identity of this stub; it may have restarted or removed all identities, run identity-stub again", target)
+	}
+	return target, identity, nil
+}
+
+// stubPlugin is an identity-v1 conversation with the plugin behind identity
+// stubs, run locally or on an upstream agent
+type stubPlugin struct {
+	r     *bufio.Reader
+	w     io.Writer
+	close func()
+}
+
+// startStubPlugin starts the identity-v1 state machine of a plugin
+func (s *Server) startStubPlugin(target string, req *handshakeRequest, sess *session) (*stubPlugin, error) {
+	if upstreamPath, ok := s.config.Upstreams[target]; ok {
+		opts := handshakeOptions{StateMachine: "identity-v1", Hops: req.Options.Hops, Via: req.Options.Via}
+		conn, err := dialUpstream(upstreamPath, target, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &stubPlugin{r: bufio.NewReader(conn), w: conn, close: func() { conn.Close() }}, nil
+	}
+
+	pluginPath, err := findPluginBinary(target)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(pluginPath, "--age-plugin=identity-v1")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", HopsEnvVar, req.Options.Hops+1))
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin: %w", err)
+	}
+	sess.setProcess(cmd.Process)
+	sess.log.Info("plugin started", "path", pluginPath, "pid", cmd.Process.Pid)
+
+	return &stubPlugin{
+		r: bufio.NewReader(stdout),
+		w: stdin,
+		close: func() {
+			// The plugin is done or abandoned at this point
+			stdin.Close()
+			signalProcessGroup(cmd.Process, syscall.SIGTERM)
+			cmd.Wait()
+			sess.log.Info("plugin exited", "path", pluginPath, "pid", cmd.Process.Pid)
+		},
+	}, nil
+}
+
+// relayStubPlugin lets the plugin behind identity stubs try the files no
+// other identity decrypted. The policy, the plugin's client prompt and its
+// PIN requests apply as in a relayed session of that plugin, and its other
+// interactive commands pass through to age. It reports whether age gave up.
+func (s *Server) relayStubPlugin(ageTap *protocolTap, target string, identities []string, files map[int][]*Stanza,
+	fileIndexes []int, resolved map[int]bool, req *handshakeRequest, sess *session) (bool, error) {
+	// Phase 1 hands the real identities and the remaining files to the plugin
+	var phase1 []*Stanza
+	for _, identity := range identities {
+		phase1 = append(phase1, &Stanza{Type: "add-identity", Args: []string{identity}})
+	}
+	for _, fileIndex := range fileIndexes {
+		if !resolved[fileIndex] {
+			phase1 = append(phase1, files[fileIndex]...)
+		}
+	}
+
+	// The policy sees the session age would have had with the plugin, and
+	// can deny it before the plugin runs
+	policy := sess.policy.stubSession(target)
+	for _, stanza := range append(phase1, &Stanza{Type: "done"}) {
+		if err := s.checkPolicy(sess, policy, stanza.Type); err != nil {
+			ageTap.deny(err)
+			return true, nil
+		}
+	}
+
+	p, err := s.startStubPlugin(target, req, sess)
+	if err != nil {
+		sess.log.Warn("failed to start plugin for identity stub", "target", target, "err", err)
+		ageTap.deny(err)
+		return true, nil
+	}
+	defer p.close()
+	t := &protocolTap{ageR: ageTap.ageR, ageW: ageTap.ageW, pluginR: p.r, pluginW: p.w}
+
+	for _, stanza := range phase1 {
+		if err := t.toPlugin(stanza); err != nil {
+			return false, err
+		}
+	}
+
+	// Repeated file keys for a file are acknowledged to the plugin, but only
+	// the first one goes to age
+	stubReq := &handshakeRequest{PluginName: target, Options: req.Options}
+	gaveUp, err := s.relayPlugin(t, stubReq, policy, sess, func(command *Stanza) (bool, error) {
+		if command.Type != "file-key" {
+			return false, nil
+		}
+		if len(command.Args) != 1 {
+			return false, fmt.Errorf("malformed file-key command from plugin")
+		}
+		fileIndex, err := strconv.Atoi(command.Args[0])
+		if err != nil || files[fileIndex] == nil {
+			return false, fmt.Errorf("malformed file index from plugin: %q", command.Args[0])
+		}
+		if resolved[fileIndex] {
+			return true, t.toPlugin(&Stanza{Type: "ok"})
+		}
+		resolved[fileIndex] = true
+		sess.log.Info("file key unwrapped by plugin", "file", fileIndex, "target", target)
+		return false, nil
+	})
+	// A refusal or denial already ended the session at age
+	if errors.Is(err, errClientRefused) || errors.Is(err, errPolicyDenied) {
+		return true, nil
+	}
+	return gaveUp, err
+}
+
+// handleStub answers the stub control command: the arguments are the
+// plugin name and, optionally, a base64 encoded plugin identity to hold
+func (s *Server) handleStub(conn net.Conn, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		conn.Write([]byte("ERROR stub requires a plugin name\n"))
+		return fmt.Errorf("stub requires a plugin name")
+	}
+
+	target := args[0]
+	if err := validatePluginName(target); err != nil || target == AgentPluginName {
+		conn.Write([]byte(fmt.Sprintf("ERROR invalid plugin name: %s\n", target)))
+		return fmt.Errorf("invalid plugin name: %s", target)
+	}
+	if _, ok := s.config.Upstreams[target]; !ok {
+		if _, err := findPluginBinary(target); err != nil {
+			conn.Write([]byte(fmt.Sprintf("ERROR plugin not found: %s\n", target)))
+			return err
+		}
+	}
+
+	if len(args) == 1 {
+		return writeControlResponse(conn, encodeStub(target, nil))
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		conn.Write([]byte("ERROR malformed identity\n"))
+		return fmt.Errorf("malformed identity: %w", err)
+	}
+	identity := string(decoded)
+	if key, err := bech32.ParseKey(identity); err != nil || key.Kind != bech32.PluginIdentity || key.Plugin != target {
+		conn.Write([]byte(fmt.Sprintf("ERROR not an identity of the %s plugin\n", target)))
+		return fmt.Errorf("not an identity of the %s plugin", target)
+	}
+
+	handle, err := s.stubs.add(identity)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("ERROR %v\n", err)))
+		return err
+	}
+	logger.Info("identity held for stub", "plugin", target)
+	return writeControlResponse(conn, encodeStub(target, handle))
+}
+
+// runIdentityStub implements the identity-stub subcommand. With an identity
+// file, the agent holds the plugin's identities in it and a stub is printed
+// for each; without, the stub stands for the plugin's default identity.
+func runIdentityStub(pluginName string, path string) error {
+	var identities []string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read identity file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			key, err := bech32.ParseKey(line)
+			if err == nil && key.Kind == bech32.PluginIdentity && key.Plugin == pluginName {
+				identities = append(identities, line)
+			}
+		}
+		if len(identities) == 0 {
+			return fmt.Errorf("%s contains no identities of the %s plugin", path, pluginName)
+		}
+	}
+
+	var stubs []string
+	if len(identities) == 0 {
+		var stub string
+		if err := dialControl("stub", []string{pluginName}, &stub); err != nil {
+			return err
+		}
+		stubs = append(stubs, stub)
+	}
+	for _, identity := range identities {
+		var stub string
+		args := []string{pluginName, base64.StdEncoding.EncodeToString([]byte(identity))}
+		if err := dialControl("stub", args, &stub); err != nil {
+			return err
+		}
+		stubs = append(stubs, stub)
+	}
+
+	fmt.Printf("# %s plugin identity served by age-plugin-agent\n", pluginName)
+	for _, stub := range stubs {
+		fmt.Println(stub)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+func TestParseStub(t *testing.T) {
+	tests := []struct {
+		name       string
+		identity   string
+		wantTarget string
+		wantHandle []byte
+		wantErr    bool
+	}{
+		{"plain agent identity", plugin.EncodeIdentity(AgentPluginName, nil), "", nil, false},
+		{"default identity stub", encodeStub("yubikey", nil), "yubikey", nil, false},
+		{"held identity stub", encodeStub("yubikey", []byte{1, 2, 3}), "yubikey", []byte{1, 2, 3}, false},
+		{"other plugin identity", plugin.EncodeIdentity("yubikey", nil), "", nil, true},
+		{"stub for the agent plugin", plugin.EncodeIdentity(AgentPluginName, []byte(AgentPluginName)), "", nil, true},
+		{"invalid plugin name", plugin.EncodeIdentity(AgentPluginName, []byte("../x")), "", nil, true},
+		{"not an identity", "AGE-PLUGIN-AGENT-1", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, handle, err := parseStub(tt.identity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStub() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if target != tt.wantTarget || !bytes.Equal(handle, tt.wantHandle) {
+				t.Errorf("parseStub() = %q, %x, want %q, %x", target, handle, tt.wantTarget, tt.wantHandle)
+			}
+		})
+	}
+}
+
+func TestResolveAgentIdentity(t *testing.T) {
+	server := newServer(&Config{})
+	held := plugin.EncodeIdentity("yubikey", []byte("slot 1"))
+	handle, err := server.stubs.add(held)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		identity     string
+		wantTarget   string
+		wantIdentity string
+		wantErr      bool
+	}{
+		{"plain agent identity", plugin.EncodeIdentity(AgentPluginName, nil), "", "", false},
+		{"default identity stub", encodeStub("yubikey", nil), "yubikey", plugin.EncodeIdentity("yubikey", nil), false},
+		{"held identity stub", encodeStub("yubikey", handle), "yubikey", held, false},
+		{"unknown handle", encodeStub("yubikey", make([]byte, stubHandleSize)), "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, identity, err := server.resolveAgentIdentity(tt.identity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveAgentIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if target != tt.wantTarget || identity != tt.wantIdentity {
+				t.Errorf("resolveAgentIdentity() = %q, %q, want %q, %q", target, identity, tt.wantTarget, tt.wantIdentity)
+			}
+		})
+	}
+
+	t.Run("removed", func(t *testing.T) {
+		if n := server.stubs.removeAll(); n != 1 {
+			t.Errorf("removeAll() = %d, want 1", n)
+		}
+		if _, _, err := server.resolveAgentIdentity(encodeStub("yubikey", handle)); err == nil {
+			t.Errorf("resolveAgentIdentity() of a removed identity should fail")
+		}
+	})
+}
+
+// fakeIdentityPlugin installs an age-plugin-fake on PATH that asks for the
+// PIN 123456 and then unwraps file 0 to a file key of sevens when age hands
+// it the given identity
+func fakeIdentityPlugin(t *testing.T, identity string) {
+	t.Helper()
+
+	script := `#!/bin/sh
+matched=
+while read line; do
+	[ "$line" = "-> add-identity ` + identity + `" ] && matched=1
+	[ "$line" = "-> done" ] && break
+done
+read body
+if [ -n "$matched" ]; then
+	printf -- '-> request-secret\nRW50ZXIgUElO\n'
+	read response
+	read pin
+	if [ "$pin" = "MTIzNDU2" ]; then
+		printf -- '-> file-key 0\nBwcHBwcHBwcHBwcHBwcHBw\n'
+		read response
+		read body
+	fi
+fi
+printf -- '-> done\n\n'
+`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "age-plugin-fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestServeAgentPluginStub(t *testing.T) {
+	held := plugin.EncodeIdentity("fake", []byte("held"))
+	fakeIdentityPlugin(t, held)
+
+	stanzas := []*age.Stanza{{Type: "fake", Args: []string{"arg"}, Body: []byte("wrapped")}}
+	pinOnAgent := map[string]string{"fake": "PIN"}
+
+	tests := []struct {
+		name    string
+		config  Config
+		handle  bool
+		unknown bool
+		want    []string
+		denied  bool
+	}{
+		{
+			name:   "held identity with PIN on the agent",
+			config: Config{SecretPrompts: pinOnAgent},
+			handle: true,
+			want:   []string{"file-key", "done"},
+		},
+		{
+			name:   "PIN asked at the client",
+			handle: true,
+			want:   []string{"request-secret", "done"},
+		},
+		{
+			name:   "client prompt",
+			config: Config{SecretPrompts: pinOnAgent, ClientPrompts: map[string]string{"fake": clientPromptMsg}},
+			handle: true,
+			want:   []string{"msg", "file-key", "done"},
+		},
+		{
+			name:   "default identity",
+			config: Config{SecretPrompts: pinOnAgent},
+			want:   []string{"done"},
+		},
+		{
+			name:    "unknown handle",
+			unknown: true,
+			want:    []string{"error"},
+		},
+		{
+			name: "denied by policy",
+			config: Config{SecretPrompts: pinOnAgent, Policy: []PolicyRule{
+				{Plugin: AgentPluginName, Action: policyAllow},
+				{Plugin: "fake", StateMachine: "identity-v1", Action: policyDeny},
+			}},
+			handle: true,
+			want:   []string{"error"},
+			denied: true,
+		},
+		{
+			name: "file key denied by policy",
+			config: Config{SecretPrompts: pinOnAgent, Policy: []PolicyRule{
+				{Plugin: "fake", Message: "file-key", Action: policyDeny},
+			}},
+			handle: true,
+			want:   []string{"error"},
+			denied: true,
+		},
+		{
+			name: "confirmed on the agent",
+			config: Config{SecretPrompts: pinOnAgent, Pinentry: "confirm", Policy: []PolicyRule{
+				{Plugin: "fake", StateMachine: "identity-v1", Action: policyConfirm},
+			}},
+			handle: true,
+			want:   []string{"file-key", "done"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config.Pinentry != "" {
+				tt.config.Pinentry = fakePinentry(t, "", true)
+			}
+			server := newServer(&tt.config)
+			if err := server.pins.set("fake", []byte("123456")); err != nil {
+				t.Fatal(err)
+			}
+			identity := encodeStub("fake", nil)
+			if tt.handle {
+				handle, err := server.stubs.add(held)
+				if err != nil {
+					t.Fatal(err)
+				}
+				identity = encodeStub("fake", handle)
+			}
+			if tt.unknown {
+				identity = encodeStub("fake", make([]byte, stubHandleSize))
+			}
+
+			commands := runAgentPlugin(t, server, identity, [][]*age.Stanza{stanzas})
+
+			var got []string
+			for _, command := range commands {
+				got = append(got, command.Type)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("commands = %v, want %v", got, tt.want)
+			}
+			if got[0] == "file-key" && !bytes.Equal(commands[0].Body, bytes.Repeat([]byte{7}, 16)) {
+				t.Errorf("file key = %x", commands[0].Body)
+			}
+			if tt.denied && !strings.Contains(string(commands[0].Body), errPolicyDenied.Error()) {
+				t.Errorf("error = %q, want a policy denial", commands[0].Body)
+			}
+		})
+	}
+}
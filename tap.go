@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Values of the client_prompts configuration
+const (
+	clientPromptMsg     = "msg"
+	clientPromptConfirm = "confirm"
+)
+
+// tappedStateMachines are the state machines whose protocol the agent relays
+// stanza by stanza; other state machines are relayed as plain bytes
+var tappedStateMachines = map[string]bool{
+	"identity-v1":  true,
+	"recipient-v1": true,
+}
+
+// errClientRefused reports that the user at the client refused a session
+var errClientRefused = errors.New("refused at the client")
+
+// protocolTap is the agent's position between age and a plugin: it reads
+// and writes whole stanzas on both sides
+type protocolTap struct {
+	ageR    *bufio.Reader
+	ageW    io.Writer
+	pluginR *bufio.Reader
+	pluginW io.Writer
+}
+
+// fromAge reads the next stanza age sent
+func (t *protocolTap) fromAge() (*Stanza, error) {
+	stanza, err := readStanza(t.ageR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from age: %w", err)
+	}
+	return stanza, nil
+}
+
+// toAge writes a stanza to age
+func (t *protocolTap) toAge(stanza *Stanza) error {
+	if err := writeStanza(t.ageW, stanza); err != nil {
+		return fmt.Errorf("failed to write to age: %w", err)
+	}
+	return nil
+}
+
+// fromPlugin reads the next stanza the plugin sent
+func (t *protocolTap) fromPlugin() (*Stanza, error) {
+	stanza, err := readStanza(t.pluginR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from plugin: %w", err)
+	}
+	return stanza, nil
+}
+
+// toPlugin writes a stanza to the plugin
+func (t *protocolTap) toPlugin(stanza *Stanza) error {
+	if err := writeStanza(t.pluginW, stanza); err != nil {
+		return fmt.Errorf("failed to write to plugin: %w", err)
+	}
+	return nil
+}
+
+// ask sends a command of the agent's own to age and returns age's response,
+// which the plugin never sees
+func (t *protocolTap) ask(command *Stanza) (*Stanza, error) {
+	if err := t.toAge(command); err != nil {
+		return nil, err
+	}
+	return t.fromAge()
+}
+
+// relay passes a command of the plugin on to age, and age's response back to
+// the plugin. It reports whether age gave up, which it does after an error
+// for the same reason as with sendError.
+func (t *protocolTap) relay(command *Stanza) (bool, error) {
+	if err := t.toAge(command); err != nil {
+		return false, err
+	}
+
+	response, err := t.fromAge()
+	if err != nil {
+		return false, err
+	}
+	if err := t.toPlugin(response); err != nil {
+		return false, err
+	}
+	return command.Type == "error", nil
+}
+
+// sendError ends the session at age with an error command of the agent's
+// own. age gives up after acknowledging an error, and the client may be gone
+// before the acknowledgement arrives, so a missing one is no failure.
+func (t *protocolTap) sendError(command *Stanza) {
+	t.ask(command)
+}
+
+// deny ends the session at age with an error and returns err
+func (t *protocolTap) deny(err error) error {
+	t.sendError(errorStanza(fmt.Sprintf("age-plugin-agent: %v", err)))
+	return err
+}
+
+// relayProtocol relays one run of an age plugin state machine between age
+// and a plugin. Unlike a byte copy, this lets the agent send age commands of
+// its own between those of the plugin.
+func (s *Server) relayProtocol(ageConn io.ReadWriter, pluginIn io.Writer, pluginOut io.Reader, req *handshakeRequest, sess *session) error {
+	t := &protocolTap{
+		ageR:    bufio.NewReader(&countingReader{r: ageConn, count: &sess.bytesIn}),
+		ageW:    ageConn,
+		pluginR: bufio.NewReader(&countingReader{r: pluginOut, count: &sess.bytesOut}),
+		pluginW: pluginIn,
+	}
+
+	// Phase 1: age sends its commands, the plugin only reads. age only
+	// listens once it is done, so a denial has to wait until then.
+	var denied error
+	for {
+		stanza, err := t.fromAge()
+		if err != nil {
+			return err
+		}
+		if denied == nil {
+			denied = s.checkPolicy(sess, sess.policy, stanza.Type)
+		}
+		if stanza.Type == "done" {
+			break
+		}
+		if denied != nil {
+			continue
+		}
+		if err := t.toPlugin(stanza); err != nil {
+			return err
+		}
+	}
+	if denied != nil {
+		return t.deny(denied)
+	}
+
+	if gaveUp, err := s.relayPlugin(t, req, sess.policy, sess, nil); err != nil || gaveUp {
+		return err
+	}
+	return t.toAge(&Stanza{Type: "done"})
+}
+
+// relayPlugin relays a plugin's part of a session once the plugin has read
+// phase 1. Before the plugin acts, the user at the client is involved as
+// configured. Then age answers every command of the plugin, except for the
+// PIN requests the agent answers itself, and the policy sees each of them.
+// intercept, if set, sees the commands first and reports whether it dealt
+// with them. relayPlugin returns when the plugin is done, without telling
+// age, and reports whether age gave up instead, including after a denial.
+func (s *Server) relayPlugin(t *protocolTap, req *handshakeRequest, policy *policySession, sess *session,
+	intercept func(command *Stanza) (bool, error)) (bool, error) {
+	if err := s.promptClient(t, req, sess); err != nil {
+		return errors.Is(err, errClientRefused), err
+	}
+	if err := t.toPlugin(&Stanza{Type: "done"}); err != nil {
+		return false, err
+	}
+
+	var attempt pinAttempt
+	for {
+		command, err := t.fromPlugin()
+		if err != nil {
+			return false, err
+		}
+		if err := s.checkPolicy(sess, policy, command.Type); err != nil {
+			return true, t.deny(err)
+		}
+		answered, err := s.answerSecret(t, command, req.PluginName, sess, &attempt)
+		if err != nil {
+			return false, err
+		}
+		if answered {
+			continue
+		}
+		if command.Type == "done" {
+			return false, nil
+		}
+		if intercept != nil {
+			handled, err := intercept(command)
+			if err != nil {
+				return false, err
+			}
+			if handled {
+				continue
+			}
+		}
+
+		if gaveUp, err := t.relay(command); err != nil || gaveUp {
+			return gaveUp, err
+		}
+	}
+}
+
+// promptClient tells the user at the client that the agent is about to use
+// a plugin for them, or asks them to approve it, if the configuration says
+// so for the plugin. It returns errClientRefused if the user declines.
+func (s *Server) promptClient(t *protocolTap, req *handshakeRequest, sess *session) error {
+	prompt := s.config.ClientPrompts[req.PluginName]
+	if prompt == "" {
+		return nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+	operation := "decrypt"
+	if req.Options.StateMachine == "recipient-v1" {
+		operation = "encrypt"
+	}
+	via := "directly"
+	if len(req.Options.Via) > 0 {
+		via = "via " + strings.Join(req.Options.Via, " -> ")
+	}
+	message := fmt.Sprintf("age-plugin-agent on %s will use the %s plugin to %s for %s, connected %s",
+		host, req.PluginName, operation, sess.peer, via)
+
+	if prompt == clientPromptMsg {
+		_, err := t.ask(&Stanza{Type: "msg", Body: []byte(message)})
+		return err
+	}
+
+	yes := base64.RawStdEncoding.EncodeToString([]byte("Continue"))
+	no := base64.RawStdEncoding.EncodeToString([]byte("Cancel"))
+	response, err := t.ask(&Stanza{Type: "confirm", Args: []string{yes, no}, Body: []byte(message + ". Continue?")})
+	if err != nil {
+		return err
+	}
+
+	// age fails the command when it can't ask, which refuses as well
+	if response.Type == "ok" && len(response.Args) == 1 && response.Args[0] == "yes" {
+		sess.log.Info("plugin use confirmed at the client")
+		return nil
+	}
+	sess.log.Warn("plugin use refused at the client", "response", response.Type)
+
+	return t.deny(fmt.Errorf("use of the %s plugin was %w", req.PluginName, errClientRefused))
+}
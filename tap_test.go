@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// tapResult records what each side of a relayed session saw
+type tapResult struct {
+	ageSaw    []string
+	pluginSaw []string
+	err       error
+}
+
+// pluginPhase2 scripts the commands of a fake plugin once it got done, and
+// returns what it saw of age's responses
+type pluginPhase2 func(r *bufio.Reader, w io.Writer) []string
+
+// unwrapOneFile is a plugin that reports a file key for file 0
+func unwrapOneFile(r *bufio.Reader, w io.Writer) []string {
+	var saw []string
+	writeStanza(w, &Stanza{Type: "file-key", Args: []string{"0"}, Body: make([]byte, 16)})
+	if response, err := readStanza(r); err == nil {
+		saw = append(saw, response.Type)
+	}
+	writeStanza(w, &Stanza{Type: "done"})
+	return saw
+}
+
+// runTap relays an identity-v1 session between a scripted age, which
+// answers confirm with confirmAnswer, and a plugin that runs phase2
+func runTap(t *testing.T, server *Server, pluginName string, confirmAnswer string, phase2 pluginPhase2) tapResult {
+	t.Helper()
+
+	serverConn, ageConn := net.Pipe()
+	pluginInR, pluginInW := io.Pipe()
+	pluginOutR, pluginOutW := io.Pipe()
+
+	// The plugin reads phase 1 and runs phase 2 once it got done
+	pluginDone := make(chan []string, 1)
+	go func() {
+		defer pluginOutW.Close()
+		var saw []string
+		reader := bufio.NewReader(pluginInR)
+		for {
+			stanza, err := readStanza(reader)
+			if err != nil {
+				pluginDone <- append(saw, "eof")
+				return
+			}
+			saw = append(saw, stanza.Type)
+			if stanza.Type == "done" {
+				break
+			}
+		}
+		pluginDone <- append(saw, phase2(reader, pluginOutW)...)
+	}()
+
+	// age sends phase 1 and answers the commands it gets
+	ageDone := make(chan []string, 1)
+	go func() {
+		defer ageConn.Close()
+		writeStanza(ageConn, &Stanza{Type: "add-identity", Args: []string{"AGE-PLUGIN-TEST-1"}})
+		writeStanza(ageConn, &Stanza{Type: "recipient-stanza", Args: []string{"0", "test"}, Body: []byte("wrapped")})
+		writeStanza(ageConn, &Stanza{Type: "done"})
+
+		var saw []string
+		reader := bufio.NewReader(ageConn)
+		for {
+			command, err := readStanza(reader)
+			if err != nil {
+				break
+			}
+			saw = append(saw, command.Type)
+			if command.Type == "done" {
+				break
+			}
+			response := &Stanza{Type: "ok"}
+			if command.Type == "confirm" {
+				response.Args = []string{confirmAnswer}
+				if confirmAnswer == "" {
+					response = &Stanza{Type: "fail"}
+				}
+			}
+			writeStanza(ageConn, response)
+			if command.Type == "error" {
+				break
+			}
+		}
+		ageDone <- saw
+	}()
+
+	req := &handshakeRequest{PluginName: pluginName, Options: handshakeOptions{StateMachine: "identity-v1"}}
+	sess := server.sessions.add(pluginName, "test")
+	sess.policy = newPolicySession(serverConn, req)
+	err := server.relayProtocol(serverConn, pluginInW, pluginOutR, req, sess)
+	pluginInW.Close()
+	pluginOutR.Close()
+	serverConn.Close()
+
+	return tapResult{ageSaw: <-ageDone, pluginSaw: <-pluginDone, err: err}
+}
+
+func TestRelayProtocol(t *testing.T) {
+	server := newServer(&Config{ClientPrompts: map[string]string{
+		"noticed":   clientPromptMsg,
+		"confirmed": clientPromptConfirm,
+	}})
+
+	tests := []struct {
+		name          string
+		plugin        string
+		confirmAnswer string
+		wantAge       []string
+		wantPlugin    []string
+		wantErr       error
+	}{
+		{
+			name:       "no prompt",
+			plugin:     "plain",
+			wantAge:    []string{"file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:       "msg before the plugin acts",
+			plugin:     "noticed",
+			wantAge:    []string{"msg", "file-key", "done"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:          "confirmed",
+			plugin:        "confirmed",
+			confirmAnswer: "yes",
+			wantAge:       []string{"confirm", "file-key", "done"},
+			wantPlugin:    []string{"add-identity", "recipient-stanza", "done", "ok"},
+		},
+		{
+			name:          "refused",
+			plugin:        "confirmed",
+			confirmAnswer: "no",
+			wantAge:       []string{"confirm", "error"},
+			wantPlugin:    []string{"add-identity", "recipient-stanza", "eof"},
+			wantErr:       errClientRefused,
+		},
+		{
+			name:       "age cannot ask",
+			plugin:     "confirmed",
+			wantAge:    []string{"confirm", "error"},
+			wantPlugin: []string{"add-identity", "recipient-stanza", "eof"},
+			wantErr:    errClientRefused,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := runTap(t, server, tt.plugin, tt.confirmAnswer, unwrapOneFile)
+			if !errors.Is(result.err, tt.wantErr) {
+				t.Fatalf("relayProtocol() error = %v, want %v", result.err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(result.ageSaw, tt.wantAge) {
+				t.Errorf("age saw %v, want %v", result.ageSaw, tt.wantAge)
+			}
+			if !reflect.DeepEqual(result.pluginSaw, tt.wantPlugin) {
+				t.Errorf("plugin saw %v, want %v", result.pluginSaw, tt.wantPlugin)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// stdinReader is shared so that consecutive prompts can read consecutive lines
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// readPassphrase prompts for a passphrase on the controlling terminal with
+// echo disabled. Without a terminal it reads a line from stdin instead so
+// that scripts can pipe the passphrase in.
+func readPassphrase(prompt string) ([]byte, error) {
+	passphrase, err := readTTYPassphrase(prompt)
+	if errors.Is(err, errNoTerminal) {
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	return passphrase, err
+}
+
+// errNoTerminal reports that the process has no controlling terminal
+var errNoTerminal = errors.New("no terminal available")
+
+// readTTYPassphrase prompts for a passphrase on the controlling terminal
+// with echo disabled
+func readTTYPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errNoTerminal
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+
+	// There is no portable terminal API in the standard library, so let stty
+	// toggle echo on the terminal
+	if err := setTerminalEcho(tty, false); err != nil {
+		return nil, err
+	}
+	defer func() {
+		setTerminalEcho(tty, true)
+		fmt.Fprintln(tty)
+	}()
+
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// confirmOnTTY asks a yes or no question on the controlling terminal
+func confirmOnTTY(question string) (bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, errNoTerminal
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%s [y/N] ", question)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("failed to read answer: %w", err)
+	}
+
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes", nil
+}
+
+// setTerminalEcho enables or disables echo on a terminal
+func setTerminalEcho(tty *os.File, echo bool) error {
+	mode := "-echo"
+	if echo {
+		mode = "echo"
+	}
+
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = tty
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to configure terminal: %w", err)
+	}
+	return nil
+}
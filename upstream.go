@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// dialUpstream connects to an upstream agent and performs the handshake for
+// a session we forward to it, adding ourselves to the hop count and route
+func dialUpstream(socketPath string, pluginName string, opts handshakeOptions) (net.Conn, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream agent at %s: %w", socketPath, err)
+	}
+
+	upstreamOpts := handshakeOptions{
+		StateMachine: opts.StateMachine,
+		Hops:         opts.Hops + 1,
+		Via:          append(append([]string{}, opts.Via...), localHostName()),
+	}
+	if err := performClientHandshake(conn, pluginName, upstreamOpts); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream agent at %s: %w", socketPath, err)
+	}
+
+	return conn, nil
+}
+
+// forwardToUpstream proxies data between the client and an upstream agent
+// until the upstream agent closes the connection
+func forwardToUpstream(conn net.Conn, upstream net.Conn, sess *session) error {
+	sess.setUpstream(upstream)
+	defer upstream.Close()
+
+	// Goroutine: client -> upstream, half-closing so the upstream plugin sees EOF
+	inDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(upstream, &countingReader{r: conn, count: &sess.bytesIn})
+		if unixConn, ok := upstream.(*net.UnixConn); ok {
+			unixConn.CloseWrite()
+		}
+		inDone <- err
+	}()
+
+	// Upstream -> client, until the upstream plugin exits
+	_, outErr := io.Copy(conn, &countingReader{r: upstream, count: &sess.bytesOut})
+
+	sess.tellCancelled(conn)
+
+	// Close connections to stop the other goroutine
+	conn.Close()
+	upstream.Close()
+	inErr := <-inDone
+
+	if sess.isCancelled() {
+		return fmt.Errorf("session %d cancelled", sess.id)
+	}
+	if outErr != nil && !errors.Is(outErr, net.ErrClosed) {
+		return fmt.Errorf("upstream to socket error: %w", outErr)
+	}
+	if inErr != nil && !errors.Is(inErr, net.ErrClosed) {
+		return fmt.Errorf("socket to upstream error: %w", inErr)
+	}
+
+	return nil
+}
+
+// localHostName returns the host name to record in the route of forwarded sessions
+func localHostName() string {
+	hostName, err := os.Hostname()
+	if err != nil || !hostNameRegex.MatchString(hostName) {
+		return "unknown"
+	}
+	return hostName
+}